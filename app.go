@@ -3,8 +3,8 @@ package doubleteam
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/msales/double-team/streaming"
@@ -19,34 +19,226 @@ func (ae applicationErrors) Error() string {
 	return fmt.Sprintf("app: Failed to close %d producers cleanly.", len(ae))
 }
 
-var errUnhealthy = errors.New("app: service unhealthy")
+// sendError is an error returned from Send.
+type sendError struct {
+	msg       string
+	temporary bool
+}
+
+func (e *sendError) Error() string {
+	return e.msg
+}
+
+// Temporary reports whether the message may be queued when retried after a
+// short delay.
+func (e *sendError) Temporary() bool {
+	return e.temporary
+}
+
+// ErrQueueFull is the error returned from Send when the first queue stays
+// saturated. It is temporary.
+var ErrQueueFull error = &sendError{msg: "app: queue full", temporary: true}
+
+// ErrBlackHoled is the error messages are rejected with when no producer could store them.
+var ErrBlackHoled = errors.New("app: message black-holed")
+
+// ErrUnavailable is the error returned from Send while the black-hole is
+// disabled and messages have recently fallen through the producer chain.
+var ErrUnavailable error = &sendError{msg: "app: producer chain failing, black-hole disabled"}
+
+// healthError is returned by IsHealthy when the Application is not fully healthy.
+type healthError struct {
+	reason   string
+	degraded bool
+}
+
+func (e *healthError) Error() string {
+	if e.degraded {
+		return "app: service degraded: " + e.reason
+	}
+	return "app: service unhealthy: " + e.reason
+}
+
+// Degraded reports whether the Application still accepts messages.
+func (e *healthError) Degraded() bool {
+	return e.degraded
+}
+
+// Health defaults.
+const (
+	DefaultHealthThreshold = 1
+	DefaultHealthWindow    = time.Minute
+)
+
+// OptFunc represents a configuration function for Application.
+type OptFunc func(a *Application)
+
+// WithHealthThreshold sets the number of black-holed messages within the
+// health window at which the Application becomes unhealthy.
+func WithHealthThreshold(n int64) OptFunc {
+	return OptFunc(func(a *Application) {
+		a.healthThreshold = n
+	})
+}
+
+// WithHealthWindow sets the sliding window over which black-holed messages
+// are counted. It is also the period the Application needs to recover.
+func WithHealthWindow(d time.Duration) OptFunc {
+	return OptFunc(func(a *Application) {
+		a.blackHoled = newSlidingCounter(d)
+	})
+}
+
+// WithQueueSizes sets the size of the queue in front of each producer, in
+// chain order. Producers without a positive size use the default queue size.
+func WithQueueSizes(sizes ...int) OptFunc {
+	return OptFunc(func(a *Application) {
+		a.queueSizes = sizes
+	})
+}
+
+// WithBlackHole sets whether the Application keeps accepting messages after
+// messages have been black-holed. When disabled, the Application refuses new
+// messages with ErrUnavailable while messages are black-holed within the
+// health window. It does not make the chain block or retry: messages that
+// are already queued when the first loss happens still fall through to the
+// black-hole and are rejected.
+func WithBlackHole(allowed bool) OptFunc {
+	return OptFunc(func(a *Application) {
+		a.blackHole = allowed
+	})
+}
+
+// WithMirror adds a leg every message is also sent to, in parallel with the
+// producer chain. The leg is a producer chain of its own, falling back from
+// one producer to the next and ending in its own black-hole, with the given
+// queue sizes in chain order.
+//
+// Mirrors are best effort: a message is acknowledged or rejected by the
+// producer chain alone. A copy is dropped when the mirror queue is full, and
+// copies black-holed by a mirror are neither rejected nor counted toward the
+// health of the Application; both are counted in the mirror_lost statistic.
+// Use WithAckedMirror when every message must reach the mirror.
+func WithMirror(producers []streaming.Producer, queueSizes ...int) OptFunc {
+	return OptFunc(func(a *Application) {
+		a.mirrors = append(a.mirrors, leg{producers: producers, queueSizes: queueSizes, mirror: true})
+	})
+}
+
+// WithAckedMirror adds a mirror leg, like WithMirror, that must also store
+// every message before it is acknowledged. Copies wait for space in the
+// mirror queue instead of being dropped, so a slow mirror holds back the
+// producer chain. A message is rejected when the mirror black-holes its
+// copy, even if the producer chain stored it; mirror producers and losses
+// still do not count toward the health of the Application.
+func WithAckedMirror(producers []streaming.Producer, queueSizes ...int) OptFunc {
+	return OptFunc(func(a *Application) {
+		a.mirrors = append(a.mirrors, leg{producers: producers, queueSizes: queueSizes, mirror: true, acked: true})
+	})
+}
+
+// leg is a producer chain messages are sent to.
+type leg struct {
+	producers  []streaming.Producer
+	queueSizes []int
+	mirror     bool
+	acked      bool
+}
+
+// mirrorInput is the input queue of a mirror leg.
+type mirrorInput struct {
+	ch    chan *streaming.Message
+	acked bool
+}
 
 // Application represents the application.
 type Application struct {
-	producers []streaming.Producer
-	messages  chan *streaming.Message
+	producers  []streaming.Producer
+	messages   chan *streaming.Message
+	queueSize  int
+	queueSizes []int
+	blackHole  bool
+	mirrors    []leg
 
 	statsTimer *time.Ticker
 
-	errorCount  int64
-	unhealthy   bool
-	closeErrors chan error
+	healthThreshold int64
+	blackHoled      *slidingCounter
+	closeErrors     chan error
 }
 
 // NewApplication creates an instance of Application.
-func NewApplication(ctx context.Context, producers []streaming.Producer, queueSize int) *Application {
+func NewApplication(ctx context.Context, producers []streaming.Producer, queueSize int, opts ...OptFunc) *Application {
 	closeMutex := sync.WaitGroup{}
 	app := &Application{
-		producers:   producers,
-		messages:    make(chan *streaming.Message, queueSize),
-		closeErrors: make(chan error),
+		producers:       producers,
+		queueSize:       queueSize,
+		blackHole:       true,
+		healthThreshold: DefaultHealthThreshold,
+		blackHoled:      newSlidingCounter(DefaultHealthWindow),
+		closeErrors:     make(chan error),
+	}
+
+	for _, opt := range opts {
+		opt(app)
 	}
 
 	channels := map[string]*chan *streaming.Message{}
+	legs := sync.WaitGroup{}
+
+	primary := leg{producers: app.producers, queueSizes: app.queueSizes}
+	if len(app.mirrors) == 0 {
+		app.messages = app.wire(ctx, primary, channels, &closeMutex, &legs)
+	} else {
+		// Wire the fan-out to the producer chain and every mirror
+		app.messages = make(chan *streaming.Message, app.queueSize)
+		channels["fan-out"] = &app.messages
+
+		input := app.wire(ctx, primary, channels, &closeMutex, &legs)
+		var mirrors []mirrorInput
+		for _, l := range app.mirrors {
+			mirrors = append(mirrors, mirrorInput{ch: app.wire(ctx, l, channels, &closeMutex, &legs), acked: l.acked})
+		}
+
+		go func() {
+			for msg := range app.messages {
+				fanOut(ctx, msg, input, mirrors)
+			}
+
+			close(input)
+			for _, m := range mirrors {
+				close(m.ch)
+			}
+		}()
+	}
+
+	go func() {
+		legs.Wait()
+		closeMutex.Wait()
+		close(app.closeErrors)
+	}()
+
+	app.statsTimer = time.NewTicker(1 * time.Second)
+	go func() {
+		for range app.statsTimer.C {
+			for k, ch := range channels {
+				_ = stats.Gauge(ctx, "queue_length", float64(len(*ch)), 1.0, "queue", k)
+				_ = stats.Gauge(ctx, "queue_length_max", float64(cap(*ch)), 1.0, "queue", k)
+			}
+		}
+	}()
 
-	// Wire the producer chain
-	ch := &app.messages
-	for _, p := range app.producers {
+	return app
+}
+
+// wire wires the producer chain of a leg, ending in a black-hole, and
+// returns its input queue. The black-hole signals legs once the chain is
+// drained. Messages black-holed by a mirror leg only count as mirror losses;
+// rejecting their copies only reaches the sender for acked mirrors.
+func (a *Application) wire(ctx context.Context, l leg, channels map[string]*chan *streaming.Message, closeMutex, legs *sync.WaitGroup) chan *streaming.Message {
+	input := make(chan *streaming.Message, a.tierQueueSize(l.queueSizes, 0))
+	ch := &input
+	for i, p := range l.producers {
 		channels[p.Name()] = ch
 		go func(ch *chan *streaming.Message, p streaming.Producer) {
 			for msg := range *ch {
@@ -55,11 +247,11 @@ func NewApplication(ctx context.Context, producers []streaming.Producer, queueSi
 			}
 
 			closeMutex.Add(1)
-			app.closeErrors <- p.Close()
+			a.closeErrors <- p.Close()
 			closeMutex.Done()
 		}(ch, p)
 
-		newCh := make(chan *streaming.Message, queueSize)
+		newCh := make(chan *streaming.Message, a.tierQueueSize(l.queueSizes, i+1))
 		ch = &newCh
 		go func(ch *chan *streaming.Message, p streaming.Producer) {
 			for err := range p.Errors() {
@@ -74,38 +266,182 @@ func NewApplication(ctx context.Context, producers []streaming.Producer, queueSi
 	}
 
 	// Wire the black-hole
+	legs.Add(1)
 	go func(ch *chan *streaming.Message) {
-		for range *ch {
-			atomic.AddInt64(&app.errorCount, 1)
+		for msg := range *ch {
+			if l.mirror {
+				_ = stats.Inc(ctx, "mirror_lost", 1, 1.0, "reason", "black-hole")
+				msg.Reject(ErrBlackHoled)
+				continue
+			}
+
+			a.blackHoled.Inc()
+			msg.Reject(ErrBlackHoled)
 			_ = stats.Inc(ctx, "produced", 1, 1.0, "queue", "black-hole")
 		}
 
-		closeMutex.Wait()
-		close(app.closeErrors)
+		legs.Done()
 	}(ch)
 
-	app.statsTimer = time.NewTicker(1 * time.Second)
-	go func() {
-		for range app.statsTimer.C {
-			for k, ch := range channels {
-				_ = stats.Gauge(ctx, "queue_length", float64(len(*ch)), 1.0, "queue", k)
-				_ = stats.Gauge(ctx, "queue_length_max", float64(cap(*ch)), 1.0, "queue", k)
+	return input
+}
+
+// tierQueueSize returns the size of the queue in front of the i-th producer
+// of a leg, or of its black-hole.
+func (a *Application) tierQueueSize(sizes []int, i int) int {
+	if i < len(sizes) && sizes[i] > 0 {
+		return sizes[i]
+	}
+	return a.queueSize
+}
+
+// fanOut sends the message to the primary leg and a copy of it to each
+// mirror leg. Copies for best effort mirrors are sent without blocking, so
+// a slow mirror cannot hold back the primary leg; copies a full mirror queue
+// cannot take are dropped. With acked mirrors, the message is acknowledged
+// once the primary leg and every acked mirror stored it.
+func fanOut(ctx context.Context, msg *streaming.Message, primary chan<- *streaming.Message, mirrors []mirrorInput) {
+	var acks *legAcks
+	for _, m := range mirrors {
+		if m.acked {
+			if acks == nil {
+				acks = &legAcks{msg: msg, pending: 1}
 			}
+			acks.pending++
 		}
-	}()
+	}
 
-	return app
+	if acks != nil {
+		primary <- acks.copy(true)
+	} else {
+		primary <- msg
+	}
+
+	for _, m := range mirrors {
+		if m.acked {
+			m.ch <- acks.copy(false)
+			continue
+		}
+
+		c := *msg
+		c.Ack = nil
+		c.Nack = nil
+
+		select {
+		case m.ch <- &c:
+		default:
+			_ = stats.Inc(ctx, "mirror_lost", 1, 1.0, "reason", "queue-full")
+		}
+	}
+}
+
+// legAcks acknowledges a message once every leg its copies were sent to
+// has stored them, with the producer of the primary leg, or rejects it with
+// the first error once every leg is done.
+type legAcks struct {
+	msg *streaming.Message
+
+	mu       sync.Mutex
+	pending  int
+	producer string
+	err      error
+}
+
+// copy returns a copy of the message that reports to the tracker.
+func (l *legAcks) copy(primary bool) *streaming.Message {
+	m := *l.msg
+	once := sync.Once{}
+	m.Ack = func(producer string) {
+		once.Do(func() {
+			l.done(primary, producer, nil)
+		})
+	}
+	m.Nack = func(err error) {
+		once.Do(func() {
+			l.done(primary, "", err)
+		})
+	}
+	return &m
+}
+
+func (l *legAcks) done(primary bool, producer string, err error) {
+	l.mu.Lock()
+	if primary {
+		l.producer = producer
+	}
+	if err != nil && l.err == nil {
+		l.err = err
+	}
+	l.pending--
+	last := l.pending == 0
+	l.mu.Unlock()
+
+	if !last {
+		return
+	}
+
+	if l.err != nil {
+		l.msg.Reject(l.err)
+		return
+	}
+	l.msg.Acknowledge(l.producer)
 }
 
 // Send sends a message to the producer chain.
-func (a *Application) Send(topic string, key, data []byte) {
-	a.messages <- &streaming.Message{
+func (a *Application) Send(ctx context.Context, topic string, key, data []byte) error {
+	return a.SendMessage(ctx, &streaming.Message{
 		Topic: topic,
 		Key:   key,
 		Data:  data,
+	})
+}
+
+// SendMessage sends a prepared message to the producer chain.
+//
+// When the first queue is full, SendMessage waits for space until the
+// context is done and then returns ErrQueueFull. A context that is already
+// done makes the send non-blocking. A context canceled while waiting means
+// the caller gave up; its error is returned and no backpressure is counted.
+//
+// The message is acknowledged by the producer that stores it; messages
+// that reach the black-hole are rejected with ErrBlackHoled. While the
+// black-hole is disabled and messages are black-holed, SendMessage returns
+// ErrUnavailable; messages queued before that are still black-holed.
+func (a *Application) SendMessage(ctx context.Context, msg *streaming.Message) error {
+	if !a.blackHole && a.blackHoled.Count() > 0 {
+		_ = stats.Inc(ctx, "unavailable", 1, 1.0, "queue", a.queueName())
+		return ErrUnavailable
+	}
+
+	select {
+	case a.messages <- msg:
+		return nil
+	default:
+	}
+
+	waiting := ctx.Err() == nil
+	select {
+	case a.messages <- msg:
+		return nil
+	case <-ctx.Done():
+		if waiting && ctx.Err() == context.Canceled {
+			return ctx.Err()
+		}
+		_ = stats.Inc(ctx, "backpressure", 1, 1.0, "queue", a.queueName())
+		return ErrQueueFull
 	}
 }
 
+func (a *Application) queueName() string {
+	if len(a.mirrors) > 0 {
+		return "fan-out"
+	}
+	if len(a.producers) == 0 {
+		return "black-hole"
+	}
+	return a.producers[0].Name()
+}
+
 // Close closes the application and cleans up.
 func (a *Application) Close() error {
 	close(a.messages)
@@ -124,16 +460,85 @@ func (a *Application) Close() error {
 }
 
 // IsHealthy checks the health of the Application.
+//
+// The Application is unhealthy while the number of black-holed messages
+// within the health window reaches the threshold, or when no producer of
+// the producer chain is healthy. It is degraded, but still accepting
+// messages, while messages are black-holed below the threshold or some
+// producers of the chain are unhealthy. Mirror producers are not checked.
 func (a *Application) IsHealthy() error {
-	if a.unhealthy {
-		return errUnhealthy
+	if n := a.blackHoled.Count(); n >= a.healthThreshold {
+		return &healthError{reason: fmt.Sprintf("%d messages black-holed", n)}
+	} else if n > 0 {
+		return &healthError{reason: fmt.Sprintf("%d messages black-holed", n), degraded: true}
 	}
 
-	errs := atomic.LoadInt64(&a.errorCount)
-	if errs > 0 {
-		a.unhealthy = true
-		return errUnhealthy
+	var unhealthy []string
+	for _, p := range a.producers {
+		if !p.IsHealthy() {
+			unhealthy = append(unhealthy, p.Name())
+		}
 	}
 
-	return nil
+	switch {
+	case len(unhealthy) == 0:
+		return nil
+	case len(unhealthy) == len(a.producers):
+		return &healthError{reason: "no healthy producers"}
+	default:
+		return &healthError{reason: "producers " + strings.Join(unhealthy, ", ") + " unhealthy", degraded: true}
+	}
+}
+
+// slidingCounter counts events over a sliding time window.
+type slidingCounter struct {
+	window     time.Duration
+	resolution time.Duration
+
+	mu      sync.Mutex
+	buckets map[int64]int64
+}
+
+func newSlidingCounter(window time.Duration) *slidingCounter {
+	resolution := window / 10
+	if resolution < time.Millisecond {
+		resolution = time.Millisecond
+	}
+
+	return &slidingCounter{
+		window:     window,
+		resolution: resolution,
+		buckets:    map[int64]int64{},
+	}
+}
+
+// Inc records an event.
+func (c *slidingCounter) Inc() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buckets[c.bucket(time.Now())]++
+}
+
+// Count returns the number of events within the window.
+func (c *slidingCounter) Count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldest := c.bucket(time.Now().Add(-c.window))
+
+	var n int64
+	for b, count := range c.buckets {
+		if b <= oldest {
+			delete(c.buckets, b)
+			continue
+		}
+		n += count
+	}
+
+	return n
+}
+
+func (c *slidingCounter) bucket(t time.Time) int64 {
+	return t.UnixNano() / int64(c.resolution)
 }
@@ -22,7 +22,7 @@ func TestSendsMessageToProducer(t *testing.T) {
 	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{p}, 1)
 	defer app.Close()
 
-	app.Send("test", []byte("test"), []byte("test"))
+	_ = app.Send(context.Background(), "test", []byte("test"), []byte("test"))
 
 	// Wait for the message to be processed
 	time.Sleep(100 * time.Millisecond)
@@ -30,6 +30,365 @@ func TestSendsMessageToProducer(t *testing.T) {
 	assert.Equal(t, 1, count)
 }
 
+func TestSendMessagePassesMessageToProducer(t *testing.T) {
+	msg := &streaming.Message{Topic: "test"}
+	var got *streaming.Message
+	p := newFuncProducer(func(m *streaming.Message) {
+		got = m
+	})
+	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{p}, 1)
+	defer app.Close()
+
+	_ = app.SendMessage(context.Background(), msg)
+
+	// Wait for the message to be processed
+	time.Sleep(100 * time.Millisecond)
+
+	assert.True(t, msg == got)
+}
+
+func TestSendMessageRejectsBlackHoledMessages(t *testing.T) {
+	p := newErrorProducer()
+	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{p}, 1)
+	defer app.Close()
+
+	rejected := make(chan error, 1)
+	_ = app.SendMessage(context.Background(), &streaming.Message{
+		Topic: "test",
+		Nack: func(err error) {
+			rejected <- err
+		},
+	})
+
+	select {
+	case err := <-rejected:
+		assert.Equal(t, doubleteam.ErrBlackHoled, err)
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "message was not rejected")
+	}
+}
+
+func TestSendReturnsErrQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	p := newFuncProducer(func(m *streaming.Message) {
+		<-block
+	})
+	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{p}, 1)
+	defer app.Close()
+	defer close(block)
+
+	// One message is held by the producer, one by the chain and the last fills the queue
+	for i := 0; i < 3; i++ {
+		err := app.Send(context.Background(), "test", nil, nil)
+		assert.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := app.Send(ctx, "test", nil, nil)
+	assert.Equal(t, doubleteam.ErrQueueFull, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = app.Send(ctx, "test", nil, nil)
+	assert.Equal(t, doubleteam.ErrQueueFull, err)
+
+	// a caller giving up while waiting is not backpressure
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = app.Send(ctx, "test", nil, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSendReturnsErrUnavailableWithoutBlackHole(t *testing.T) {
+	p := newErrorProducer()
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{p},
+		1,
+		doubleteam.WithBlackHole(false),
+		doubleteam.WithHealthWindow(100*time.Millisecond),
+	)
+	defer app.Close()
+
+	err := app.Send(context.Background(), "test", nil, nil)
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	err = app.Send(context.Background(), "test", nil, nil)
+	assert.Equal(t, doubleteam.ErrUnavailable, err)
+
+	// Wait for the window to pass
+	time.Sleep(150 * time.Millisecond)
+
+	err = app.Send(context.Background(), "test", nil, nil)
+	assert.NoError(t, err)
+
+	// Wait for the message to be processed
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestWithQueueSizes(t *testing.T) {
+	block := make(chan struct{})
+	p := newFuncProducer(func(m *streaming.Message) {
+		<-block
+	})
+	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{p}, 1, doubleteam.WithQueueSizes(3))
+	defer app.Close()
+	defer close(block)
+
+	// One message is held by the producer, one by the chain and the last three fill the queue
+	for i := 0; i < 5; i++ {
+		err := app.Send(context.Background(), "test", nil, nil)
+		assert.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := app.Send(ctx, "test", nil, nil)
+	assert.Equal(t, doubleteam.ErrQueueFull, err)
+}
+
+func TestWithMirrorSendsMessageToEveryLeg(t *testing.T) {
+	stored := make(chan string, 2)
+	primary := newFuncProducer(func(m *streaming.Message) {
+		stored <- "primary"
+		m.Acknowledge("primary")
+	})
+	mirror := newFuncProducer(func(m *streaming.Message) {
+		stored <- "mirror"
+		m.Acknowledge("mirror")
+	})
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{primary},
+		1,
+		doubleteam.WithMirror([]streaming.Producer{mirror}),
+	)
+	defer app.Close()
+
+	acked := make(chan string, 2)
+	_ = app.SendMessage(context.Background(), &streaming.Message{
+		Topic: "test",
+		Ack: func(producer string) {
+			acked <- producer
+		},
+	})
+
+	// Wait for the message to be processed
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Len(t, stored, 2)
+	assert.Len(t, acked, 1)
+	assert.Equal(t, "primary", <-acked)
+}
+
+func TestWithMirrorIgnoresMessagesBlackHoledByAMirror(t *testing.T) {
+	primary := newFuncProducer(func(m *streaming.Message) {
+		m.Acknowledge("primary")
+	})
+	mirror := newErrorProducer()
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{primary},
+		1,
+		doubleteam.WithMirror([]streaming.Producer{mirror}),
+	)
+	defer app.Close()
+
+	acked := make(chan string, 1)
+	_ = app.SendMessage(context.Background(), &streaming.Message{
+		Topic: "test",
+		Ack: func(producer string) {
+			acked <- producer
+		},
+		Nack: func(err error) {
+			assert.Fail(t, "message was rejected")
+		},
+	})
+
+	select {
+	case producer := <-acked:
+		assert.Equal(t, "primary", producer)
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "message was not acknowledged")
+	}
+
+	// Wait for the mirror copy to be black-holed
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, app.IsHealthy())
+}
+
+func TestWithMirrorDoesNotBlockOnASlowMirror(t *testing.T) {
+	primary := newFuncProducer(func(m *streaming.Message) {
+		m.Acknowledge("primary")
+	})
+	release := make(chan struct{})
+	mirror := newFuncProducer(func(m *streaming.Message) {
+		<-release
+	})
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{primary},
+		1,
+		doubleteam.WithMirror([]streaming.Producer{mirror}),
+	)
+	defer app.Close()
+	defer close(release)
+
+	acked := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		err := app.SendMessage(context.Background(), &streaming.Message{
+			Topic: "test",
+			Ack: func(producer string) {
+				acked <- producer
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	// Wait for the messages to be processed
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Len(t, acked, 10)
+}
+
+func TestWithAckedMirrorAcknowledgesOnceEveryLegStoredTheMessage(t *testing.T) {
+	primary := newFuncProducer(func(m *streaming.Message) {
+		m.Acknowledge("primary")
+	})
+	release := make(chan struct{})
+	mirror := newFuncProducer(func(m *streaming.Message) {
+		<-release
+		m.Acknowledge("mirror")
+	})
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{primary},
+		1,
+		doubleteam.WithAckedMirror([]streaming.Producer{mirror}),
+	)
+	defer app.Close()
+
+	acked := make(chan string, 1)
+	_ = app.SendMessage(context.Background(), &streaming.Message{
+		Topic: "test",
+		Ack: func(producer string) {
+			acked <- producer
+		},
+	})
+
+	// Wait for the primary leg to store the message
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, acked, 0)
+
+	close(release)
+	select {
+	case producer := <-acked:
+		assert.Equal(t, "primary", producer)
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "message was not acknowledged")
+	}
+}
+
+func TestWithAckedMirrorRejectsMessagesBlackHoledByTheMirror(t *testing.T) {
+	primary := newFuncProducer(func(m *streaming.Message) {
+		m.Acknowledge("primary")
+	})
+	mirror := newErrorProducer()
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{primary},
+		1,
+		doubleteam.WithAckedMirror([]streaming.Producer{mirror}),
+	)
+	defer app.Close()
+
+	rejected := make(chan error, 1)
+	_ = app.SendMessage(context.Background(), &streaming.Message{
+		Topic: "test",
+		Ack: func(producer string) {
+			assert.Fail(t, "message was acknowledged")
+		},
+		Nack: func(err error) {
+			rejected <- err
+		},
+	})
+
+	select {
+	case err := <-rejected:
+		assert.Equal(t, doubleteam.ErrBlackHoled, err)
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "message was not rejected")
+	}
+
+	// mirror losses do not count toward the health
+	assert.NoError(t, app.IsHealthy())
+}
+
+func TestWithAckedMirrorWaitsForASlowMirror(t *testing.T) {
+	primary := newFuncProducer(func(m *streaming.Message) {
+		m.Acknowledge("primary")
+	})
+	release := make(chan struct{})
+	mirror := newFuncProducer(func(m *streaming.Message) {
+		<-release
+		m.Acknowledge("mirror")
+	})
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{primary},
+		1,
+		doubleteam.WithAckedMirror([]streaming.Producer{mirror}),
+	)
+	defer app.Close()
+
+	accepted := 0
+	acked := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := app.SendMessage(ctx, &streaming.Message{
+			Topic: "test",
+			Ack: func(producer string) {
+				acked <- producer
+			},
+		})
+		cancel()
+		if err == nil {
+			accepted++
+		}
+	}
+
+	// the full mirror queue pushes back instead of dropping copies
+	assert.True(t, accepted < 10)
+	assert.Len(t, acked, 0)
+
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.Len(t, acked, accepted)
+}
+
+func TestIsHealthyIgnoresMirrorProducers(t *testing.T) {
+	unhealthy := &unhealthyProducer{newFuncProducer(func(*streaming.Message) {})}
+	mirror := newFuncProducer(func(*streaming.Message) {})
+
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{unhealthy},
+		1,
+		doubleteam.WithMirror([]streaming.Producer{mirror}),
+	)
+	defer app.Close()
+
+	err := app.IsHealthy()
+	assert.Error(t, err)
+	assert.False(t, isDegraded(err))
+}
+
 func TestIsUnhealthyIfRecordsAreBlackHoled(t *testing.T) {
 	p := newErrorProducer()
 	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{p}, 1)
@@ -38,7 +397,7 @@ func TestIsUnhealthyIfRecordsAreBlackHoled(t *testing.T) {
 	err := app.IsHealthy()
 	assert.NoError(t, err)
 
-	app.Send("test", []byte("test"), []byte("test"))
+	_ = app.Send(context.Background(), "test", []byte("test"), []byte("test"))
 
 	// Wait for the message to be processed
 	time.Sleep(100 * time.Millisecond)
@@ -50,6 +409,61 @@ func TestIsUnhealthyIfRecordsAreBlackHoled(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestIsDegradedBelowThresholdAndRecovers(t *testing.T) {
+	p := newErrorProducer()
+	app := doubleteam.NewApplication(
+		context.Background(),
+		[]streaming.Producer{p},
+		1,
+		doubleteam.WithHealthThreshold(2),
+		doubleteam.WithHealthWindow(200*time.Millisecond),
+	)
+	defer app.Close()
+
+	_ = app.Send(context.Background(), "test", []byte("test"), []byte("test"))
+	time.Sleep(50 * time.Millisecond)
+
+	err := app.IsHealthy()
+	assert.Error(t, err)
+	assert.True(t, isDegraded(err))
+
+	_ = app.Send(context.Background(), "test", []byte("test"), []byte("test"))
+	time.Sleep(50 * time.Millisecond)
+
+	err = app.IsHealthy()
+	assert.Error(t, err)
+	assert.False(t, isDegraded(err))
+
+	// Wait for the window to pass
+	time.Sleep(250 * time.Millisecond)
+
+	err = app.IsHealthy()
+	assert.NoError(t, err)
+}
+
+func TestIsHealthyChecksProducers(t *testing.T) {
+	healthy := newFuncProducer(func(*streaming.Message) {})
+	unhealthy := &unhealthyProducer{newFuncProducer(func(*streaming.Message) {})}
+
+	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{unhealthy, healthy}, 1)
+	err := app.IsHealthy()
+	assert.Error(t, err)
+	assert.True(t, isDegraded(err))
+	app.Close()
+
+	unhealthy = &unhealthyProducer{newFuncProducer(func(*streaming.Message) {})}
+	app = doubleteam.NewApplication(context.Background(), []streaming.Producer{unhealthy}, 1)
+	err = app.IsHealthy()
+	assert.Error(t, err)
+	assert.False(t, isDegraded(err))
+	app.Close()
+}
+
+func isDegraded(err error) bool {
+	d, ok := err.(interface{ Degraded() bool })
+	return ok && d.Degraded()
+}
+
 func TestCloseReturnsProducerErrors(t *testing.T) {
 	p := newErrorProducer()
 	app := doubleteam.NewApplication(context.Background(), []streaming.Producer{p}, 1)
@@ -146,3 +560,21 @@ func (p *funcProducer) Close() error {
 func (p *funcProducer) IsHealthy() bool {
 	return true
 }
+
+type unhealthyProducer struct {
+	streaming.Producer
+}
+
+func (p *unhealthyProducer) IsHealthy() bool {
+	return false
+}
+
+func TestSendErrorsAreOnlyTemporaryWhenTheQueueIsFull(t *testing.T) {
+	isTemporary := func(err error) bool {
+		e, ok := err.(interface{ Temporary() bool })
+		return ok && e.Temporary()
+	}
+
+	assert.True(t, isTemporary(doubleteam.ErrQueueFull))
+	assert.False(t, isTemporary(doubleteam.ErrUnavailable))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+
+	"github.com/msales/double-team/streaming"
+	"github.com/msales/pkg/v3/clix"
+	"github.com/msales/pkg/v3/log"
+	"github.com/msales/pkg/v3/stats"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func runCleanup(c *cli.Context) {
+	ctx, err := clix.NewContext(c)
+	if err != nil {
+		log.Fatal(ctx, err.Error())
+	}
+
+	retention := c.Duration(FlagCleanupOlderThan)
+	if retention <= 0 {
+		log.Fatal(ctx, "the retention of restored objects must be set")
+	}
+
+	cleaner, err := streaming.NewS3Cleaner(
+		c.String(FlagS3Endpoint),
+		c.String(FlagS3Region),
+		c.String(FlagS3Bucket),
+		newRestored(ctx, ""),
+	)
+	if err != nil {
+		log.Fatal(ctx, err.Error())
+	}
+
+	dryRun := c.Bool(FlagRestoreDryRun)
+	before := time.Now().Add(-retention)
+	log.Info(ctx, "Starting cleanup", "before", before.UTC().Format(time.RFC3339), "dry-run", dryRun)
+
+	var removed int
+	err = cleaner.Clean(before, dryRun, func(key string) {
+		removed++
+		log.Debug(ctx, "Removed restored object", "key", key)
+		stats.Inc(ctx, "cleaned", 1, 1.0)
+	})
+	if err != nil {
+		log.Error(ctx, err.Error())
+	}
+
+	log.Info(ctx, "Done", "objects", removed)
+}
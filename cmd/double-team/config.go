@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/msales/double-team"
+	"github.com/msales/double-team/streaming"
+	"gopkg.in/yaml.v2"
+)
+
+// config is the producer chain configuration file.
+//
+//	queue: 1000
+//	black-hole: true
+//	producers:
+//	  - name: kafka
+//	    type: kafka
+//	    brokers: [kafka:9092]
+//	    version: 2.3.0
+//	  - name: s3
+//	    type: s3
+//	    bucket: archive
+//	chain:
+//	  - producer: kafka
+//	  - producer: s3
+//	    queue: 5000
+//	mirrors:
+//	  - chain:
+//	      - producer: s3-backup
+type config struct {
+	// Queue is the default queue size of the tiers.
+	Queue int `yaml:"queue"`
+	// BlackHole sets whether new messages are accepted after messages failed
+	// every tier. Messages failing every tier are always rejected. Accepted
+	// if not set.
+	BlackHole *bool `yaml:"black-hole"`
+	// Producers declares the producers the chain is built from.
+	Producers []producerConfig `yaml:"producers"`
+	// Chain is the order of the tiers. Defaults to the order of the producers.
+	Chain []tierConfig `yaml:"chain"`
+	// Mirrors are the chains every message is also sent to.
+	Mirrors []mirrorConfig `yaml:"mirrors"`
+}
+
+type producerConfig struct {
+	Name     string                 `yaml:"name"`
+	Type     string                 `yaml:"type"`
+	Settings map[string]interface{} `yaml:",inline"`
+}
+
+type mirrorConfig struct {
+	Chain []tierConfig `yaml:"chain"`
+	// Ack sets whether messages are only acknowledged once the mirror stored
+	// them too.
+	Ack bool `yaml:"ack"`
+}
+
+type tierConfig struct {
+	Producer string `yaml:"producer"`
+	Queue    int    `yaml:"queue"`
+}
+
+// loadConfig reads and validates a configuration file.
+func loadConfig(path string) (*config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (cfg *config) validate() error {
+	if len(cfg.Producers) == 0 {
+		return fmt.Errorf("no producers declared")
+	}
+
+	names := map[string]bool{}
+	for _, p := range cfg.Producers {
+		if p.Name == "" {
+			return fmt.Errorf("producer of type %q has no name", p.Type)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate producer %q", p.Name)
+		}
+		if _, ok := producerFactories[p.Type]; !ok {
+			return fmt.Errorf("producer %q has unknown type %q", p.Name, p.Type)
+		}
+		names[p.Name] = true
+	}
+
+	if len(cfg.Chain) == 0 {
+		for _, p := range cfg.Producers {
+			cfg.Chain = append(cfg.Chain, tierConfig{Producer: p.Name})
+		}
+	}
+
+	chains := [][]tierConfig{cfg.Chain}
+	for _, m := range cfg.Mirrors {
+		if len(m.Chain) == 0 {
+			return fmt.Errorf("mirror has an empty chain")
+		}
+		chains = append(chains, m.Chain)
+	}
+
+	tiers := map[string]bool{}
+	for _, chain := range chains {
+		for _, t := range chain {
+			if !names[t.Producer] {
+				return fmt.Errorf("chain references unknown producer %q", t.Producer)
+			}
+			if tiers[t.Producer] {
+				return fmt.Errorf("producer %q is used more than once in the chains", t.Producer)
+			}
+			tiers[t.Producer] = true
+		}
+	}
+
+	return nil
+}
+
+// blackHole reports whether messages failing every tier may be dropped.
+func (cfg *config) blackHole() bool {
+	return cfg.BlackHole == nil || *cfg.BlackHole
+}
+
+// newProducers creates the producers of the chain tiers of the given types,
+// in chain order, along with the queue size of each tier. All types are
+// created if none are given.
+func (cfg *config) newProducers(types ...string) ([]streaming.Producer, []int, error) {
+	return cfg.newChain(cfg.Chain, types...)
+}
+
+// newMirrors creates the producers of each mirror chain as application options.
+func (cfg *config) newMirrors() ([]doubleteam.OptFunc, error) {
+	var opts []doubleteam.OptFunc
+	for i, m := range cfg.Mirrors {
+		producers, sizes, err := cfg.newChain(m.Chain)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %d: %v", i+1, err)
+		}
+
+		if m.Ack {
+			opts = append(opts, doubleteam.WithAckedMirror(producers, sizes...))
+			continue
+		}
+		opts = append(opts, doubleteam.WithMirror(producers, sizes...))
+	}
+
+	return opts, nil
+}
+
+func (cfg *config) newChain(chain []tierConfig, types ...string) ([]streaming.Producer, []int, error) {
+	declared := map[string]producerConfig{}
+	for _, p := range cfg.Producers {
+		declared[p.Name] = p
+	}
+
+	var producers []streaming.Producer
+	var sizes []int
+	for _, t := range chain {
+		pc := declared[t.Producer]
+		if len(types) > 0 && !contains(types, pc.Type) {
+			continue
+		}
+
+		p, err := producerFactories[pc.Type](pc.Name, pc.Settings)
+		if err != nil {
+			for _, p := range producers {
+				_ = p.Close()
+			}
+			return nil, nil, fmt.Errorf("producer %q: %v", pc.Name, err)
+		}
+
+		producers = append(producers, p)
+		sizes = append(sizes, t.Queue)
+	}
+
+	return producers, sizes, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Producer registry ===============================
+
+// producerFactory creates a named producer from its type specific settings.
+type producerFactory func(name string, settings map[string]interface{}) (streaming.Producer, error)
+
+// producerFactories are the producer factories by producer type.
+var producerFactories = map[string]producerFactory{
+	"kafka": func(name string, settings map[string]interface{}) (streaming.Producer, error) {
+		s := defaultKafkaSettings()
+		if err := decodeSettings(settings, &s); err != nil {
+			return nil, err
+		}
+		return s.producer(name)
+	},
+	"s3": func(name string, settings map[string]interface{}) (streaming.Producer, error) {
+		s := defaultS3Settings()
+		if err := decodeSettings(settings, &s); err != nil {
+			return nil, err
+		}
+		return s.producer(name)
+	},
+	"spool": func(name string, settings map[string]interface{}) (streaming.Producer, error) {
+		s := defaultSpoolSettings()
+		if err := decodeSettings(settings, &s); err != nil {
+			return nil, err
+		}
+		return s.producer(name)
+	},
+}
+
+// decodeSettings decodes the settings into v, rejecting unknown settings.
+func decodeSettings(settings map[string]interface{}, v interface{}) error {
+	b, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	return yaml.UnmarshalStrict(b, v)
+}
+
+// Producer settings ===============================
+
+type kafkaSettings struct {
+	Brokers         []string      `yaml:"brokers"`
+	Version         string        `yaml:"version"`
+	Retry           int           `yaml:"retry"`
+	Acks            string        `yaml:"acks"`
+	Compression     string        `yaml:"compression"`
+	FlushBytes      int           `yaml:"flush-bytes"`
+	FlushMessages   int           `yaml:"flush-messages"`
+	FlushFrequency  time.Duration `yaml:"flush-frequency"`
+	MaxMessageBytes int           `yaml:"max-message-bytes"`
+	RetryBackoff    time.Duration `yaml:"retry-backoff"`
+	Partitioner     string        `yaml:"partitioner"`
+	ClientID        string        `yaml:"client-id"`
+	Idempotent      bool          `yaml:"idempotent"`
+
+	TLS struct {
+		Enabled  bool   `yaml:"enabled"`
+		CA       string `yaml:"ca"`
+		Cert     string `yaml:"cert"`
+		Key      string `yaml:"key"`
+		Insecure bool   `yaml:"insecure"`
+	} `yaml:"tls"`
+
+	SASL struct {
+		Mechanism string `yaml:"mechanism"`
+		User      string `yaml:"user"`
+		Password  string `yaml:"password"`
+	} `yaml:"sasl"`
+}
+
+func defaultKafkaSettings() kafkaSettings {
+	return kafkaSettings{
+		Retry:           streaming.DefaultKafkaRetry,
+		Acks:            streaming.DefaultKafkaAcks,
+		Compression:     streaming.DefaultKafkaCompression,
+		FlushFrequency:  streaming.DefaultKafkaFlushFrequency,
+		MaxMessageBytes: streaming.DefaultKafkaMaxMessageBytes,
+		RetryBackoff:    streaming.DefaultKafkaRetryBackoff,
+		Partitioner:     streaming.DefaultKafkaPartitioner,
+	}
+}
+
+func (s kafkaSettings) producer(name string) (streaming.Producer, error) {
+	opts := []streaming.KafkaOptFunc{
+		streaming.WithKafkaName(name),
+		streaming.WithKafkaAcks(s.Acks),
+		streaming.WithKafkaCompression(s.Compression),
+		streaming.WithKafkaFlushBytes(s.FlushBytes),
+		streaming.WithKafkaFlushMessages(s.FlushMessages),
+		streaming.WithKafkaFlushFrequency(s.FlushFrequency),
+		streaming.WithKafkaMaxMessageBytes(s.MaxMessageBytes),
+		streaming.WithKafkaRetryBackoff(s.RetryBackoff),
+		streaming.WithKafkaPartitioner(s.Partitioner),
+		streaming.WithKafkaClientID(s.ClientID),
+		streaming.WithKafkaIdempotent(s.Idempotent),
+		streaming.WithKafkaSASL(s.SASL.Mechanism, s.SASL.User, s.SASL.Password),
+	}
+
+	if s.TLS.Enabled || s.TLS.CA != "" || s.TLS.Cert != "" || s.TLS.Key != "" {
+		opts = append(opts, streaming.WithKafkaTLS(s.TLS.CA, s.TLS.Cert, s.TLS.Key, s.TLS.Insecure))
+	}
+
+	return streaming.NewKafkaProducer(s.Brokers, s.Version, s.Retry, opts...)
+}
+
+type s3Settings struct {
+	Endpoint    string `yaml:"endpoint"`
+	Region      string `yaml:"region"`
+	Bucket      string `yaml:"bucket"`
+	Compression string `yaml:"compression"`
+	KeyLayout   string `yaml:"key-layout"`
+}
+
+func defaultS3Settings() s3Settings {
+	return s3Settings{
+		Compression: string(streaming.CompressionNone),
+		KeyLayout:   streaming.DefaultKeyLayout,
+	}
+}
+
+func (s s3Settings) producer(name string) (streaming.Producer, error) {
+	layout, err := streaming.NewKeyLayout(s.KeyLayout)
+	if err != nil {
+		return nil, err
+	}
+
+	return streaming.NewS3Producer(
+		s.Endpoint,
+		s.Region,
+		s.Bucket,
+		streaming.Compression(s.Compression),
+		layout,
+		streaming.WithS3Name(name),
+	)
+}
+
+type spoolSettings struct {
+	Dir          string        `yaml:"dir"`
+	SegmentSize  int64         `yaml:"segment-size"`
+	MaxSize      int64         `yaml:"max-size"`
+	Sync         string        `yaml:"sync"`
+	SyncInterval time.Duration `yaml:"sync-interval"`
+	SealInterval time.Duration `yaml:"seal-interval"`
+}
+
+func defaultSpoolSettings() spoolSettings {
+	return spoolSettings{
+		SegmentSize:  streaming.DefaultSpoolSegmentSize,
+		Sync:         string(streaming.SyncInterval),
+		SyncInterval: streaming.DefaultSpoolSyncInterval,
+		SealInterval: streaming.DefaultSpoolSealInterval,
+	}
+}
+
+func (s spoolSettings) producer(name string) (streaming.Producer, error) {
+	if s.Dir == "" {
+		return nil, fmt.Errorf("spool: dir must be set")
+	}
+
+	return streaming.NewSpoolProducer(
+		s.Dir,
+		s.SegmentSize,
+		s.MaxSize,
+		streaming.SyncPolicy(s.Sync),
+		s.SyncInterval,
+		streaming.WithSpoolName(name),
+		streaming.WithSpoolSealInterval(s.SealInterval),
+	)
+}
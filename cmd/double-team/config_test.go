@@ -0,0 +1,239 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		err   string
+		chain []tierConfig
+	}{
+		{
+			name: "chain defaults to producer order",
+			yaml: `
+producers:
+  - name: kafka
+    type: kafka
+  - name: backup
+    type: spool
+`,
+			chain: []tierConfig{{Producer: "kafka"}, {Producer: "backup"}},
+		},
+		{
+			name: "explicit chain",
+			yaml: `
+producers:
+  - name: kafka
+    type: kafka
+  - name: backup
+    type: spool
+chain:
+  - producer: backup
+    queue: 10
+`,
+			chain: []tierConfig{{Producer: "backup", Queue: 10}},
+		},
+		{
+			name: "unknown type",
+			yaml: `
+producers:
+  - name: kafka
+    type: rabbit
+`,
+			err: `producer "kafka" has unknown type "rabbit"`,
+		},
+		{
+			name: "duplicate name",
+			yaml: `
+producers:
+  - name: kafka
+    type: kafka
+  - name: kafka
+    type: spool
+`,
+			err: `duplicate producer "kafka"`,
+		},
+		{
+			name: "producer used in two chains",
+			yaml: `
+producers:
+  - name: kafka
+    type: kafka
+  - name: backup
+    type: spool
+chain:
+  - producer: kafka
+  - producer: backup
+mirrors:
+  - chain:
+      - producer: backup
+`,
+			err: `producer "backup" is used more than once in the chains`,
+		},
+		{
+			name: "unknown producer in chain",
+			yaml: `
+producers:
+  - name: kafka
+    type: kafka
+chain:
+  - producer: s3
+`,
+			err: `chain references unknown producer "s3"`,
+		},
+		{
+			name: "empty mirror",
+			yaml: `
+producers:
+  - name: kafka
+    type: kafka
+mirrors:
+  - chain: []
+`,
+			err: "mirror has an empty chain",
+		},
+		{
+			name: "unknown top level setting",
+			yaml: `
+queues: 10
+producers:
+  - name: kafka
+    type: kafka
+`,
+			err: "field queues not found",
+		},
+		{
+			name: "no producers",
+			yaml: "queue: 10\n",
+			err:  "no producers declared",
+		},
+	}
+
+	for _, tt := range tests {
+		path := writeConfig(t, tt.yaml)
+		defer os.Remove(path)
+
+		cfg, err := loadConfig(path)
+		if tt.err != "" {
+			if assert.Error(t, err, tt.name) {
+				assert.Contains(t, err.Error(), tt.err, tt.name)
+			}
+			continue
+		}
+
+		if assert.NoError(t, err, tt.name) {
+			assert.Equal(t, tt.chain, cfg.Chain, tt.name)
+		}
+	}
+}
+
+func TestConfig_NewProducersRejectsUnknownSettings(t *testing.T) {
+	path := writeConfig(t, `
+producers:
+  - name: backup
+    type: spool
+    dir: /tmp/spool
+    segment-bytes: 1024
+`)
+	defer os.Remove(path)
+
+	cfg, err := loadConfig(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, _, err = cfg.newProducers()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `producer "backup"`)
+		assert.Contains(t, err.Error(), "field segment-bytes not found")
+	}
+}
+
+func TestConfig_BlackHole(t *testing.T) {
+	allowed, denied := true, false
+
+	assert.True(t, (&config{}).blackHole())
+	assert.True(t, (&config{BlackHole: &allowed}).blackHole())
+	assert.False(t, (&config{BlackHole: &denied}).blackHole())
+}
+
+func TestDecodeSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		err      bool
+		want     spoolSettings
+	}{
+		{
+			name:     "defaults",
+			settings: map[string]interface{}{"dir": "/tmp/spool"},
+			want: spoolSettings{
+				Dir:          "/tmp/spool",
+				SegmentSize:  64 << 20,
+				Sync:         "interval",
+				SyncInterval: time.Second,
+				SealInterval: time.Minute,
+			},
+		},
+		{
+			name: "durations",
+			settings: map[string]interface{}{
+				"dir":           "/tmp/spool",
+				"sync-interval": "250ms",
+				"seal-interval": "5m",
+			},
+			want: spoolSettings{
+				Dir:          "/tmp/spool",
+				SegmentSize:  64 << 20,
+				Sync:         "interval",
+				SyncInterval: 250 * time.Millisecond,
+				SealInterval: 5 * time.Minute,
+			},
+		},
+		{
+			name:     "unknown setting",
+			settings: map[string]interface{}{"directory": "/tmp/spool"},
+			err:      true,
+		},
+		{
+			name:     "invalid duration",
+			settings: map[string]interface{}{"sync-interval": "soon"},
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		s := defaultSpoolSettings()
+		err := decodeSettings(tt.settings, &s)
+		if tt.err {
+			assert.Error(t, err, tt.name)
+			continue
+		}
+
+		if assert.NoError(t, err, tt.name) {
+			assert.Equal(t, tt.want, s, tt.name)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "double-team-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
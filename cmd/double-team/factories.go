@@ -1,19 +1,31 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/msales/double-team"
 	"github.com/msales/double-team/server"
 	"github.com/msales/double-team/server/middleware"
 	"github.com/msales/double-team/streaming"
 	"github.com/msales/pkg/v3/clix"
+	"github.com/pkg/errors"
 )
 
 // Server =============================
 
 func newServer(ctx *clix.Context, app *doubleteam.Application) http.Handler {
-	s := server.New(app)
+	s := server.New(
+		app,
+		server.WithBatchMaxRecords(ctx.Int(FlagBatchMaxRecords)),
+		server.WithBatchMaxBytes(ctx.Int64(FlagBatchMaxBytes)),
+		server.WithSyncAck(ctx.Bool(FlagAckSync)),
+		server.WithAckTimeout(ctx.Duration(FlagAckTimeout)),
+		server.WithQueueTimeout(ctx.Duration(FlagQueueTimeout)),
+		server.WithRetryAfter(ctx.Duration(FlagRetryAfter)),
+	)
 
 	h := middleware.Common(s)
 	return middleware.WithContext(ctx, h)
@@ -21,34 +33,216 @@ func newServer(ctx *clix.Context, app *doubleteam.Application) http.Handler {
 
 // Application =============================
 
-func newApplication(c *clix.Context, producers []streaming.Producer, queueSize int) (*doubleteam.Application, error) {
-	app := doubleteam.NewApplication(c, producers, queueSize)
+func newApplication(c *clix.Context, producers []streaming.Producer, queueSize int, opts ...doubleteam.OptFunc) (*doubleteam.Application, error) {
+	opts = append([]doubleteam.OptFunc{
+		doubleteam.WithHealthThreshold(c.Int64(FlagHealthThreshold)),
+		doubleteam.WithHealthWindow(c.Duration(FlagHealthWindow)),
+	}, opts...)
+
+	app := doubleteam.NewApplication(c, producers, queueSize, opts...)
 
 	return app, nil
 }
 
 // Producers ===============================
 
-func newKafkaProducer(c *clix.Context) (streaming.Producer, error) {
-	brokers := c.StringSlice(FlagKafkaBrokers)
-	version := c.String(FlagKafkaVersion)
-	retry := c.Int(FlagKafkaRetry)
+func newKafkaProducer(c *clix.Context, prefix string) (streaming.Producer, error) {
+	flag := func(name string) string {
+		return prefix + "." + name
+	}
+
+	s := kafkaSettings{
+		Brokers:         c.StringSlice(flag(FlagKafkaBrokers)),
+		Version:         c.String(flag(FlagKafkaVersion)),
+		Retry:           c.Int(flag(FlagKafkaRetry)),
+		Acks:            c.String(flag(FlagKafkaAcks)),
+		Compression:     c.String(flag(FlagKafkaCompression)),
+		FlushBytes:      c.Int(flag(FlagKafkaFlushBytes)),
+		FlushMessages:   c.Int(flag(FlagKafkaFlushMessages)),
+		FlushFrequency:  c.Duration(flag(FlagKafkaFlushFrequency)),
+		MaxMessageBytes: c.Int(flag(FlagKafkaMaxMessageBytes)),
+		RetryBackoff:    c.Duration(flag(FlagKafkaRetryBackoff)),
+		Partitioner:     c.String(flag(FlagKafkaPartitioner)),
+		ClientID:        c.String(flag(FlagKafkaClientID)),
+		Idempotent:      c.Bool(flag(FlagKafkaIdempotent)),
+	}
+	s.TLS.Enabled = c.Bool(flag(FlagKafkaTLS))
+	s.TLS.CA = c.String(flag(FlagKafkaTLSCA))
+	s.TLS.Cert = c.String(flag(FlagKafkaTLSCert))
+	s.TLS.Key = c.String(flag(FlagKafkaTLSKey))
+	s.TLS.Insecure = c.Bool(flag(FlagKafkaTLSInsecure))
+	s.SASL.Mechanism = c.String(flag(FlagKafkaSASLMechanism))
+	s.SASL.User = c.String(flag(FlagKafkaSASLUser))
+	s.SASL.Password = c.String(flag(FlagKafkaSASLPassword))
 
-	return streaming.NewKafkaProducer(brokers, version, retry)
+	return s.producer(c.String(flag(FlagKafkaName)))
 }
 
 func newS3Producer(c *clix.Context) (streaming.Producer, error) {
-	endpoint := c.String(FlagS3Endpoint)
-	region := c.String(FlagS3Region)
-	bucket := c.String(FlagS3Bucket)
+	s := s3Settings{
+		Endpoint:    c.String(FlagS3Endpoint),
+		Region:      c.String(FlagS3Region),
+		Bucket:      c.String(FlagS3Bucket),
+		Compression: c.String(FlagS3Compression),
+		KeyLayout:   c.String(FlagS3KeyLayout),
+	}
 
-	return streaming.NewS3Producer(endpoint, region, bucket)
+	return s.producer("s3")
 }
 
-func newS3Consumer(c *clix.Context) (streaming.Consumer, error) {
+func newSpoolProducer(c *clix.Context) (streaming.Producer, error) {
+	s := spoolSettings{
+		Dir:          c.String(FlagSpoolDir),
+		SegmentSize:  c.Int64(FlagSpoolSegmentSize),
+		MaxSize:      c.Int64(FlagSpoolMaxSize),
+		Sync:         c.String(FlagSpoolSync),
+		SyncInterval: c.Duration(FlagSpoolSyncInterval),
+		SealInterval: c.Duration(FlagSpoolSealInterval),
+	}
+
+	return s.producer("spool")
+}
+
+// Consumers ===============================
+
+func newS3Consumer(c *clix.Context, runID string) (streaming.Consumer, error) {
 	endpoint := c.String(FlagS3Endpoint)
 	region := c.String(FlagS3Region)
 	bucket := c.String(FlagS3Bucket)
 
-	return streaming.NewS3Consumer(endpoint, region, bucket)
+	layout, err := streaming.NewKeyLayout(c.String(FlagS3KeyLayout))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Bool(FlagRestoreResume) && c.String(FlagRestoreCheckpoint) == "" {
+		return nil, errors.New("resume requires a checkpoint")
+	}
+
+	opts := []streaming.S3ConsumerOptFunc{
+		streaming.WithS3Concurrency(c.Int(FlagRestoreConcurrency)),
+		streaming.WithS3Restored(newRestored(c, runID)),
+	}
+	// A read-only dry run only skips the checkpoint marker, it does not
+	// overwrite the checkpoint
+	if c.Bool(FlagRestoreDryRun) {
+		opts = append(opts, streaming.WithS3ReadOnly())
+	}
+	if path := c.String(FlagRestoreCheckpoint); path != "" {
+		store, err := newCheckpointStore(c, path)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, streaming.WithS3Checkpoint(store, c.Bool(FlagRestoreResume)))
+	}
+
+	return streaming.NewS3Consumer(endpoint, region, bucket, layout, opts...)
+}
+
+func newS3Inspector(c *clix.Context) (*streaming.S3Inspector, error) {
+	layout, err := streaming.NewKeyLayout(c.String(FlagS3KeyLayout))
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []streaming.S3ConsumerOptFunc{
+		streaming.WithS3Restored(newRestored(c, "")),
+	}
+	if path := c.String(FlagRestoreCheckpoint); path != "" {
+		store, err := newCheckpointStore(c, path)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, streaming.WithS3Checkpoint(store, false))
+	}
+
+	return streaming.NewS3Inspector(c.String(FlagS3Endpoint), c.String(FlagS3Region), c.String(FlagS3Bucket), layout, opts...)
+}
+
+// newRestored creates the restored objects configuration of a restore run.
+func newRestored(c *clix.Context, runID string) streaming.Restored {
+	return streaming.Restored{
+		Mode:   streaming.RestoredMode(c.String(FlagRestored)),
+		Bucket: c.String(FlagRestoredBucket),
+		Prefix: c.String(FlagRestoredPrefix),
+		RunID:  runID,
+	}
+}
+
+// newCheckpointStore creates the checkpoint store of a local file path or an
+// 's3://bucket/key' marker object.
+func newCheckpointStore(c *clix.Context, path string) (streaming.CheckpointStore, error) {
+	if !strings.HasPrefix(path, "s3://") {
+		return streaming.NewFileCheckpointStore(path), nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(path, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid checkpoint %q, expected 's3://bucket/key'", path)
+	}
+
+	return streaming.NewS3CheckpointStore(c.String(FlagS3Endpoint), c.String(FlagS3Region), parts[0], parts[1])
+}
+
+func newSpoolConsumer(c *clix.Context) (streaming.Consumer, error) {
+	if c.String(FlagRestoreCheckpoint) != "" {
+		return nil, errors.New("checkpoints are only supported for the s3 source")
+	}
+
+	dir := c.String(FlagSpoolDir)
+
+	var opts []streaming.SpoolConsumerOptFunc
+	if c.Bool(FlagRestoreDryRun) {
+		opts = append(opts, streaming.WithSpoolReadOnly())
+	}
+
+	return streaming.NewSpoolConsumer(dir, opts...)
+}
+
+// newConsumer creates the consumer of the restore source for a restore run.
+func newConsumer(c *clix.Context, runID string) (streaming.Consumer, error) {
+	switch source := c.String(FlagRestoreSource); source {
+	case "s3":
+		return newS3Consumer(c, runID)
+	case "spool":
+		return newSpoolConsumer(c)
+	default:
+		return nil, fmt.Errorf("unknown restore source %q", source)
+	}
+}
+
+func newFilter(c *clix.Context) (streaming.Filter, error) {
+	f := streaming.Filter{
+		To:      time.Now(),
+		Include: c.StringSlice(FlagRestoreTopic),
+		Exclude: c.StringSlice(FlagRestoreSkip),
+	}
+
+	if from := c.String(FlagRestoreFrom); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return f, errors.Wrap(err, "invalid --"+FlagRestoreFrom)
+		}
+		f.From = t
+	}
+
+	if to := c.String(FlagRestoreTo); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return f, errors.Wrap(err, "invalid --"+FlagRestoreTo)
+		}
+		f.To = t
+	}
+
+	return f, f.Validate()
+}
+
+func newTopicMap(c *clix.Context) (*streaming.TopicMap, error) {
+	rules := c.StringSlice(FlagMapRule)
+	prefix := c.String(FlagMapPrefix)
+	suffix := c.String(FlagMapSuffix)
+
+	return streaming.NewTopicMap(rules, prefix, suffix)
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/msales/double-team/streaming"
+	"github.com/msales/pkg/v3/clix"
+	"github.com/msales/pkg/v3/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func runInspect(c *cli.Context) {
+	ctx, err := clix.NewContext(c)
+	if err != nil {
+		log.Fatal(ctx, err.Error())
+	}
+
+	if c.Bool(FlagInspectObjects) && c.Bool(FlagInspectDump) {
+		log.Fatal(ctx, "objects and dump cannot be combined")
+	}
+
+	filter, err := newFilter(ctx)
+	if err != nil {
+		log.Fatal(ctx, err.Error())
+	}
+
+	inspector, err := newS3Inspector(ctx)
+	if err != nil {
+		log.Fatal(ctx, err.Error())
+	}
+
+	keys := map[string]bool{}
+	for _, k := range c.StringSlice(FlagInspectKey) {
+		keys[k] = true
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	objects := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if c.Bool(FlagInspectObjects) {
+		fmt.Fprintln(objects, "TIME\tSIZE\tMESSAGES\tKEY")
+	}
+
+	dump := json.NewEncoder(out)
+	summary := newInspectSummary()
+
+	objFn := func(obj streaming.ObjectInfo) error {
+		summary.object(obj)
+		if obj.Err != nil {
+			log.Error(ctx, "Could not read object", "key", obj.Key, "error", obj.Err.Error())
+		}
+		if c.Bool(FlagInspectObjects) {
+			fmt.Fprintf(objects, "%s\t%d\t%d\t%s\n", obj.Time.UTC().Format(time.RFC3339), obj.Size, obj.Messages, obj.Key)
+		}
+		return nil
+	}
+	msgFn := func(msg *streaming.Message) error {
+		if len(keys) > 0 && !keys[string(msg.Key)] {
+			return nil
+		}
+
+		summary.message(msg)
+		if c.Bool(FlagInspectDump) {
+			return dump.Encode(msg)
+		}
+		return nil
+	}
+
+	if err := inspector.Inspect(filter, objFn, msgFn); err != nil {
+		log.Error(ctx, err.Error())
+	}
+
+	if c.Bool(FlagInspectDump) {
+		return
+	}
+
+	if c.Bool(FlagInspectObjects) {
+		objects.Flush()
+		fmt.Fprintln(out)
+	}
+	summary.write(out)
+}
+
+// inspectSummary counts the selected messages per topic.
+type inspectSummary struct {
+	objects    int
+	unreadable int
+	bytes      int64
+	topics     map[string]*topicSummary
+	current    map[string]int
+}
+
+// topicSummary is the number of selected messages of a topic and the time
+// range of the objects they were archived in.
+type topicSummary struct {
+	messages    int
+	first, last time.Time
+}
+
+func newInspectSummary() *inspectSummary {
+	return &inspectSummary{
+		topics:  map[string]*topicSummary{},
+		current: map[string]int{},
+	}
+}
+
+// message counts a selected message of the object being read.
+func (s *inspectSummary) message(msg *streaming.Message) {
+	s.current[msg.Topic]++
+}
+
+// object adds the counts of an object once it has been read.
+func (s *inspectSummary) object(obj streaming.ObjectInfo) {
+	s.objects++
+	s.bytes += obj.Size
+	if obj.Err != nil {
+		s.unreadable++
+	}
+
+	for topic, n := range s.current {
+		t, ok := s.topics[topic]
+		if !ok {
+			t = &topicSummary{first: obj.Time, last: obj.Time}
+			s.topics[topic] = t
+		}
+
+		t.messages += n
+		if obj.Time.Before(t.first) {
+			t.first = obj.Time
+		}
+		if obj.Time.After(t.last) {
+			t.last = obj.Time
+		}
+	}
+	s.current = map[string]int{}
+}
+
+func (s *inspectSummary) write(out *bufio.Writer) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	topics := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	total := 0
+	fmt.Fprintln(w, "TOPIC\tMESSAGES\tFIRST\tLAST")
+	for _, topic := range topics {
+		t := s.topics[topic]
+		total += t.messages
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", topic, t.messages, t.first.UTC().Format(time.RFC3339), t.last.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "TOTAL\t%d\t\t\n", total)
+	fmt.Fprintf(w, "\nObjects: %d, Bytes: %d", s.objects, s.bytes)
+	if s.unreadable > 0 {
+		fmt.Fprintf(w, ", Unreadable: %d", s.unreadable)
+	}
+	fmt.Fprintln(w)
+}
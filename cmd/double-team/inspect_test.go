@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/msales/double-team/streaming"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectSummary(t *testing.T) {
+	first := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	s := newInspectSummary()
+
+	s.message(&streaming.Message{Topic: "orders"})
+	s.message(&streaming.Message{Topic: "payments"})
+	s.object(streaming.ObjectInfo{Key: "b", Time: second, Size: 100})
+
+	s.message(&streaming.Message{Topic: "orders"})
+	s.object(streaming.ObjectInfo{Key: "a", Time: first, Size: 50})
+
+	// an unreadable object adds the messages read before the error
+	s.message(&streaming.Message{Topic: "orders"})
+	s.object(streaming.ObjectInfo{Key: "c", Time: second, Size: 10, Err: errors.New("test")})
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	s.write(out)
+	assert.NoError(t, out.Flush())
+
+	assert.Equal(t, ""+
+		"TOPIC     MESSAGES  FIRST                 LAST\n"+
+		"orders    3         2020-01-02T03:04:05Z  2020-01-02T04:04:05Z\n"+
+		"payments  1         2020-01-02T04:04:05Z  2020-01-02T04:04:05Z\n"+
+		"TOTAL     4                               \n"+
+		"\n"+
+		"Objects: 3, Bytes: 160, Unreadable: 1\n", buf.String())
+}
+
+func TestInspectSummary_Empty(t *testing.T) {
+	s := newInspectSummary()
+	s.object(streaming.ObjectInfo{Key: "a", Size: 10})
+
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	s.write(out)
+	assert.NoError(t, out.Flush())
+
+	assert.Contains(t, buf.String(), "TOTAL  0")
+	assert.Contains(t, buf.String(), "Objects: 1, Bytes: 10\n")
+}
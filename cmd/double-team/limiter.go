@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+
+	"github.com/msales/double-team/streaming"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter limits the rate messages are sent at, in messages and bytes
+// per second.
+type rateLimiter struct {
+	messages *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+// newRateLimiter creates a rate limiter. A limit of 0 is disabled.
+func newRateLimiter(messages, bytes int) *rateLimiter {
+	l := &rateLimiter{}
+	if messages > 0 {
+		l.messages = rate.NewLimiter(rate.Limit(messages), messages)
+	}
+	if bytes > 0 {
+		l.bytes = rate.NewLimiter(rate.Limit(bytes), bytes)
+	}
+
+	return l
+}
+
+// Wait blocks until the message may be sent or the context is done.
+func (l *rateLimiter) Wait(ctx context.Context, msg *streaming.Message) error {
+	if l.messages != nil {
+		if err := l.messages.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	if l.bytes != nil {
+		// messages larger than the burst are waited for in parts
+		n := len(msg.Key) + len(msg.Data)
+		for n > 0 {
+			part := n
+			if b := l.bytes.Burst(); part > b {
+				part = b
+			}
+			if err := l.bytes.WaitN(ctx, part); err != nil {
+				return err
+			}
+			n -= part
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/msales/double-team/streaming"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_Disabled(t *testing.T) {
+	l := newRateLimiter(0, 0)
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, l.Wait(context.Background(), &streaming.Message{Data: make([]byte, 1024)}))
+	}
+
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+}
+
+func TestRateLimiter_Messages(t *testing.T) {
+	l := newRateLimiter(10, 0)
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, l.Wait(context.Background(), &streaming.Message{}))
+	}
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "expected the burst to pass")
+
+	assert.NoError(t, l.Wait(context.Background(), &streaming.Message{}))
+	assert.True(t, time.Since(start) >= 80*time.Millisecond, "expected the limit to hold")
+}
+
+func TestRateLimiter_BytesLargerThanBurst(t *testing.T) {
+	l := newRateLimiter(0, 1000)
+
+	start := time.Now()
+	err := l.Wait(context.Background(), &streaming.Message{Key: make([]byte, 200), Data: make([]byte, 1000)})
+
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 150*time.Millisecond, "expected the bytes over the burst to be waited for")
+}
+
+func TestRateLimiter_ContextDone(t *testing.T) {
+	l := newRateLimiter(1, 0)
+	assert.NoError(t, l.Wait(context.Background(), &streaming.Message{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Error(t, l.Wait(ctx, &streaming.Message{}))
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"os"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/msales/double-team"
+	"github.com/msales/double-team/server"
+	"github.com/msales/double-team/streaming"
 	"github.com/msales/pkg/v3/clix"
 	"gopkg.in/urfave/cli.v1"
 )
@@ -11,14 +15,102 @@ import (
 // Flag constants declared for CLI use.
 const (
 	FlagQueueSize = "queue"
+	FlagConfig    = "config"
 
-	FlagKafkaBrokers = "kafka.brokers"
-	FlagKafkaVersion = "kafka.version"
-	FlagKafkaRetry   = "kafka.retry"
+	FlagHealthThreshold = "health.threshold"
+	FlagHealthWindow    = "health.window"
 
-	FlagS3Endpoint = "s3.endpoint"
-	FlagS3Region   = "s3.region"
-	FlagS3Bucket   = "s3.bucket"
+	FlagBatchMaxRecords = "batch.max-records"
+	FlagBatchMaxBytes   = "batch.max-bytes"
+
+	FlagAckSync    = "ack.sync"
+	FlagAckTimeout = "ack.timeout"
+
+	FlagQueueTimeout = "queue.timeout"
+	FlagRetryAfter   = "retry-after"
+
+	FlagRestoreDryRun = "dry-run"
+	FlagRestoreSource = "source"
+	FlagRestoreFrom   = "from"
+	FlagRestoreTo     = "to"
+	FlagRestoreTopic  = "topic"
+	FlagRestoreSkip   = "exclude-topic"
+
+	FlagRestoreConcurrency  = "concurrency"
+	FlagRestoreRateMessages = "rate.messages"
+	FlagRestoreRateBytes    = "rate.bytes"
+
+	FlagRestored       = "restored"
+	FlagRestoredBucket = "restored.bucket"
+	FlagRestoredPrefix = "restored.prefix"
+	FlagRestoredRunID  = "restored.run-id"
+
+	FlagCleanupOlderThan = "older-than"
+
+	FlagInspectObjects = "objects"
+	FlagInspectDump    = "dump"
+	FlagInspectKey     = "key"
+
+	FlagRestoreWatch         = "watch"
+	FlagRestoreWatchInterval = "watch.interval"
+	FlagRestoreWatchStable   = "watch.stable"
+
+	FlagRestoreCheckpoint = "checkpoint"
+	FlagRestoreResume     = "resume"
+
+	FlagMapRule   = "map"
+	FlagMapPrefix = "map.prefix"
+	FlagMapSuffix = "map.suffix"
+
+	FlagS3Endpoint    = "s3.endpoint"
+	FlagS3Region      = "s3.region"
+	FlagS3Bucket      = "s3.bucket"
+	FlagS3Compression = "s3.compression"
+	FlagS3KeyLayout   = "s3.key-layout"
+
+	FlagSpoolDir          = "spool.dir"
+	FlagSpoolSegmentSize  = "spool.segment-size"
+	FlagSpoolMaxSize      = "spool.max-size"
+	FlagSpoolSync         = "spool.sync"
+	FlagSpoolSyncInterval = "spool.sync-interval"
+	FlagSpoolSealInterval = "spool.seal-interval"
+)
+
+// Kafka cluster flag prefixes.
+const (
+	FlagKafka          = "kafka"
+	FlagKafkaSecondary = "kafka.secondary"
+)
+
+// Kafka flag constants declared for CLI use, relative to the cluster prefix,
+// e.g. "kafka.brokers" or "kafka.secondary.brokers".
+const (
+	FlagKafkaName = "name"
+
+	FlagKafkaBrokers = "brokers"
+	FlagKafkaVersion = "version"
+	FlagKafkaRetry   = "retry"
+
+	FlagKafkaAcks            = "acks"
+	FlagKafkaCompression     = "compression"
+	FlagKafkaFlushBytes      = "flush-bytes"
+	FlagKafkaFlushMessages   = "flush-messages"
+	FlagKafkaFlushFrequency  = "flush-frequency"
+	FlagKafkaMaxMessageBytes = "max-message-bytes"
+	FlagKafkaRetryBackoff    = "retry-backoff"
+	FlagKafkaPartitioner     = "partitioner"
+	FlagKafkaClientID        = "client-id"
+	FlagKafkaIdempotent      = "idempotent"
+
+	FlagKafkaTLS         = "tls"
+	FlagKafkaTLSCA       = "tls.ca"
+	FlagKafkaTLSCert     = "tls.cert"
+	FlagKafkaTLSKey      = "tls.key"
+	FlagKafkaTLSInsecure = "tls.insecure"
+
+	FlagKafkaSASLMechanism = "sasl.mechanism"
+	FlagKafkaSASLUser      = "sasl.user"
+	FlagKafkaSASLPassword  = "sasl.password"
 )
 
 var flags = clix.Flags{
@@ -28,6 +120,67 @@ var flags = clix.Flags{
 		Usage:  "The queue size of the message buffers.",
 		EnvVar: "DOUBLE_TEAM_QUEUE",
 	},
+	cli.StringFlag{
+		Name:   FlagConfig,
+		Usage:  "The producer chain configuration file. Replaces the producer flags when set.",
+		EnvVar: "DOUBLE_TEAM_CONFIG",
+	},
+	cli.Int64Flag{
+		Name:   FlagHealthThreshold,
+		Value:  doubleteam.DefaultHealthThreshold,
+		Usage:  "The number of black-holed messages within the health window at which the service is unhealthy.",
+		EnvVar: "DOUBLE_TEAM_HEALTH_THRESHOLD",
+	},
+	cli.DurationFlag{
+		Name:   FlagHealthWindow,
+		Value:  doubleteam.DefaultHealthWindow,
+		Usage:  "The sliding window black-holed messages are counted over, and the time needed to recover.",
+		EnvVar: "DOUBLE_TEAM_HEALTH_WINDOW",
+	},
+}
+
+var batchFlags = clix.Flags{
+	cli.IntFlag{
+		Name:   FlagBatchMaxRecords,
+		Value:  server.DefaultBatchMaxRecords,
+		Usage:  "The maximum number of records in a batch request.",
+		EnvVar: "DOUBLE_TEAM_BATCH_MAX_RECORDS",
+	},
+	cli.Int64Flag{
+		Name:   FlagBatchMaxBytes,
+		Value:  server.DefaultBatchMaxBytes,
+		Usage:  "The maximum body size of a batch request in bytes.",
+		EnvVar: "DOUBLE_TEAM_BATCH_MAX_BYTES",
+	},
+}
+
+var ackFlags = clix.Flags{
+	cli.BoolFlag{
+		Name:   FlagAckSync,
+		Usage:  "Wait for messages to be stored before responding, unless the request selects a mode.",
+		EnvVar: "DOUBLE_TEAM_ACK_SYNC",
+	},
+	cli.DurationFlag{
+		Name:   FlagAckTimeout,
+		Value:  server.DefaultAckTimeout,
+		Usage:  "The time a synchronous request waits for its messages to be stored.",
+		EnvVar: "DOUBLE_TEAM_ACK_TIMEOUT",
+	},
+}
+
+var backpressureFlags = clix.Flags{
+	cli.DurationFlag{
+		Name:   FlagQueueTimeout,
+		Value:  server.DefaultQueueTimeout,
+		Usage:  "The time a request waits for queue space before it is refused. Refused immediately if 0.",
+		EnvVar: "DOUBLE_TEAM_QUEUE_TIMEOUT",
+	},
+	cli.DurationFlag{
+		Name:   FlagRetryAfter,
+		Value:  server.DefaultRetryAfter,
+		Usage:  "The Retry-After advertised to refused requests.",
+		EnvVar: "DOUBLE_TEAM_RETRY_AFTER",
+	},
 }
 
 var s3Flags = clix.Flags{
@@ -47,27 +200,342 @@ var s3Flags = clix.Flags{
 		Usage:  "The s3 bucket.",
 		EnvVar: "DOUBLE_TEAM_S3_BUCKET",
 	},
+	cli.StringFlag{
+		Name:   FlagS3Compression,
+		Value:  string(streaming.CompressionNone),
+		Usage:  "The codec archive objects are compressed with (options: none, gzip, zstd, snappy).",
+		EnvVar: "DOUBLE_TEAM_S3_COMPRESSION",
+	},
+	cli.StringFlag{
+		Name:   FlagS3KeyLayout,
+		Value:  streaming.DefaultKeyLayout,
+		Usage:  "The key template of archive objects (placeholders: {topic}, {yyyy}, {mm}, {dd}, {hh}, {ksuid}).",
+		EnvVar: "DOUBLE_TEAM_S3_KEY_LAYOUT",
+	},
 }
 
-var kafkaFlags = clix.Flags{
-	cli.StringSliceFlag{
-		Name:   FlagKafkaBrokers,
-		Usage:  "The kafka seed brokers.",
-		EnvVar: "DOUBLE_TEAM_KAFKA_BROKERS",
+var restoreFlags = clix.Flags{
+	cli.BoolFlag{
+		Name:   FlagRestoreDryRun,
+		Usage:  "Read and count the archived messages without sending or removing them.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_DRY_RUN",
 	},
 	cli.StringFlag{
-		Name:   FlagKafkaVersion,
-		Usage:  "Kafka version.",
-		EnvVar: "DOUBLE_TEAM_KAFKA_VERSION",
+		Name:   FlagRestoreSource,
+		Value:  "s3",
+		Usage:  "The source to restore messages from (options: s3, spool).",
+		EnvVar: "DOUBLE_TEAM_RESTORE_SOURCE",
 	},
 	cli.IntFlag{
-		Name:   FlagKafkaRetry,
-		Value:  5,
-		Usage:  "The number of times to retry producing a message.",
-		EnvVar: "DOUBLE_TEAM_KAFKA_RETRY",
+		Name:   FlagRestoreConcurrency,
+		Value:  1,
+		Usage:  "The number of archive objects downloaded in parallel.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_CONCURRENCY",
+	},
+	cli.IntFlag{
+		Name:   FlagRestoreRateMessages,
+		Usage:  "The maximum number of messages sent per second. Unlimited if 0.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_RATE_MESSAGES",
+	},
+	cli.IntFlag{
+		Name:   FlagRestoreRateBytes,
+		Usage:  "The maximum number of message key and data bytes sent per second. Unlimited if 0.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_RATE_BYTES",
+	},
+	cli.BoolFlag{
+		Name:   FlagRestoreWatch,
+		Usage:  "Keep running, and restore the archive whenever Kafka has been healthy for the stable period.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_WATCH",
+	},
+	cli.DurationFlag{
+		Name:   FlagRestoreWatchInterval,
+		Value:  30 * time.Second,
+		Usage:  "The interval Kafka health is checked at in watch mode.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_WATCH_INTERVAL",
+	},
+	cli.DurationFlag{
+		Name:   FlagRestoreWatchStable,
+		Value:  5 * time.Minute,
+		Usage:  "The time Kafka must stay healthy before a restore starts in watch mode.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_WATCH_STABLE",
+	},
+	cli.StringFlag{
+		Name:   FlagRestoredRunID,
+		Usage:  "The ID of the restore recorded on moved and tagged objects. Generated if empty.",
+		EnvVar: "DOUBLE_TEAM_RESTORED_RUN_ID",
+	},
+	cli.StringFlag{
+		Name:   FlagRestoreCheckpoint,
+		Usage:  "The file or S3 marker object ('s3://bucket/key') the restore progress is kept in. Disabled if empty.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_CHECKPOINT",
+	},
+	cli.BoolFlag{
+		Name:   FlagRestoreResume,
+		Usage:  "Continue the restore from the checkpoint, skipping the objects already done.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_RESUME",
+	},
+	cli.StringSliceFlag{
+		Name:   FlagMapRule,
+		Usage:  "A topic mapping rule 'from=to' (multiple allowed). An empty target drops the topic.",
+		EnvVar: "DOUBLE_TEAM_MAP",
+	},
+	cli.StringFlag{
+		Name:   FlagMapPrefix,
+		Usage:  "A prefix added to the topics without a mapping rule.",
+		EnvVar: "DOUBLE_TEAM_MAP_PREFIX",
+	},
+	cli.StringFlag{
+		Name:   FlagMapSuffix,
+		Usage:  "A suffix added to the topics without a mapping rule, e.g. '.replay'.",
+		EnvVar: "DOUBLE_TEAM_MAP_SUFFIX",
+	},
+}
+
+var filterFlags = clix.Flags{
+	cli.StringFlag{
+		Name:   FlagRestoreFrom,
+		Usage:  "Only select messages archived at or after this time (RFC 3339).",
+		EnvVar: "DOUBLE_TEAM_RESTORE_FROM",
+	},
+	cli.StringFlag{
+		Name:   FlagRestoreTo,
+		Usage:  "Only select messages archived before this time (RFC 3339). Defaults to the start of the command.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_TO",
+	},
+	cli.StringSliceFlag{
+		Name:   FlagRestoreTopic,
+		Usage:  "A topic pattern to select, e.g. 'orders.*' (multiple allowed). All topics if not set.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_TOPICS",
+	},
+	cli.StringSliceFlag{
+		Name:   FlagRestoreSkip,
+		Usage:  "A topic pattern not to select (multiple allowed).",
+		EnvVar: "DOUBLE_TEAM_RESTORE_EXCLUDE_TOPICS",
+	},
+}
+
+var inspectFlags = clix.Flags{
+	cli.BoolFlag{
+		Name:   FlagInspectObjects,
+		Usage:  "List the archive objects with their time, size and message count.",
+		EnvVar: "DOUBLE_TEAM_INSPECT_OBJECTS",
+	},
+	cli.BoolFlag{
+		Name:   FlagInspectDump,
+		Usage:  "Dump the selected messages as NDJSON instead of the summary.",
+		EnvVar: "DOUBLE_TEAM_INSPECT_DUMP",
+	},
+	cli.StringSliceFlag{
+		Name:   FlagInspectKey,
+		Usage:  "A message key to select (multiple allowed). All keys if not set.",
+		EnvVar: "DOUBLE_TEAM_INSPECT_KEYS",
+	},
+	cli.StringFlag{
+		Name:   FlagRestoreCheckpoint,
+		Usage:  "The restore checkpoint file or S3 marker object ('s3://bucket/key'). A marker in the archive bucket is skipped.",
+		EnvVar: "DOUBLE_TEAM_RESTORE_CHECKPOINT",
 	},
 }
 
+var restoredFlags = clix.Flags{
+	cli.StringFlag{
+		Name:   FlagRestored,
+		Value:  string(streaming.RestoredDelete),
+		Usage:  "What is done with restored objects (options: delete, move, tag).",
+		EnvVar: "DOUBLE_TEAM_RESTORED",
+	},
+	cli.StringFlag{
+		Name:   FlagRestoredBucket,
+		Usage:  "The bucket restored objects are moved to. Defaults to the archive bucket.",
+		EnvVar: "DOUBLE_TEAM_RESTORED_BUCKET",
+	},
+	cli.StringFlag{
+		Name:   FlagRestoredPrefix,
+		Value:  streaming.DefaultRestoredPrefix,
+		Usage:  "The prefix restored objects are moved under. Keys under it in the archive bucket are never restored.",
+		EnvVar: "DOUBLE_TEAM_RESTORED_PREFIX",
+	},
+}
+
+var cleanupFlags = clix.Flags{
+	cli.DurationFlag{
+		Name:   FlagCleanupOlderThan,
+		Usage:  "The retention of restored objects, e.g. '720h'. Objects restored longer ago are removed.",
+		EnvVar: "DOUBLE_TEAM_CLEANUP_OLDER_THAN",
+	},
+	cli.BoolFlag{
+		Name:   FlagRestoreDryRun,
+		Usage:  "List the objects to remove without removing them.",
+		EnvVar: "DOUBLE_TEAM_CLEANUP_DRY_RUN",
+	},
+}
+
+var spoolFlags = clix.Flags{
+	cli.StringFlag{
+		Name:   FlagSpoolDir,
+		Usage:  "The local spool directory. The spool tier is disabled if empty.",
+		EnvVar: "DOUBLE_TEAM_SPOOL_DIR",
+	},
+	cli.Int64Flag{
+		Name:   FlagSpoolSegmentSize,
+		Value:  streaming.DefaultSpoolSegmentSize,
+		Usage:  "The size in bytes at which a spool segment is rotated.",
+		EnvVar: "DOUBLE_TEAM_SPOOL_SEGMENT_SIZE",
+	},
+	cli.Int64Flag{
+		Name:   FlagSpoolMaxSize,
+		Value:  0,
+		Usage:  "The maximum size in bytes of the spool directory. Unlimited if 0.",
+		EnvVar: "DOUBLE_TEAM_SPOOL_MAX_SIZE",
+	},
+	cli.StringFlag{
+		Name:   FlagSpoolSync,
+		Value:  string(streaming.SyncInterval),
+		Usage:  "When to fsync spool segments (options: always, interval, never).",
+		EnvVar: "DOUBLE_TEAM_SPOOL_SYNC",
+	},
+	cli.DurationFlag{
+		Name:   FlagSpoolSyncInterval,
+		Value:  streaming.DefaultSpoolSyncInterval,
+		Usage:  "The fsync interval of the spool when using the interval sync policy.",
+		EnvVar: "DOUBLE_TEAM_SPOOL_SYNC_INTERVAL",
+	},
+	cli.DurationFlag{
+		Name:   FlagSpoolSealInterval,
+		Value:  streaming.DefaultSpoolSealInterval,
+		Usage:  "The age at which the active spool segment is sealed, making it restorable. Disabled if 0.",
+		EnvVar: "DOUBLE_TEAM_SPOOL_SEAL_INTERVAL",
+	},
+}
+
+var kafkaFlags = newKafkaFlags(FlagKafka, "DOUBLE_TEAM_KAFKA", "kafka")
+
+var secondaryKafkaFlags = newKafkaFlags(FlagKafkaSecondary, "DOUBLE_TEAM_KAFKA_SECONDARY", "kafka-secondary")
+
+// newKafkaFlags creates the flags of a Kafka cluster under the prefix.
+func newKafkaFlags(prefix, envPrefix, name string) clix.Flags {
+	return clix.Flags{
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaName,
+			Value:  name,
+			Usage:  "The producer name used in logs, metrics and acknowledgements.",
+			EnvVar: envPrefix + "_NAME",
+		},
+		cli.StringSliceFlag{
+			Name:   prefix + "." + FlagKafkaBrokers,
+			Usage:  "The kafka seed brokers.",
+			EnvVar: envPrefix + "_BROKERS",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaVersion,
+			Usage:  "Kafka version.",
+			EnvVar: envPrefix + "_VERSION",
+		},
+		cli.IntFlag{
+			Name:   prefix + "." + FlagKafkaRetry,
+			Value:  streaming.DefaultKafkaRetry,
+			Usage:  "The number of times to retry producing a message.",
+			EnvVar: envPrefix + "_RETRY",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaAcks,
+			Value:  streaming.DefaultKafkaAcks,
+			Usage:  "The acknowledgements required from the brokers (options: none, local, all).",
+			EnvVar: envPrefix + "_ACKS",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaCompression,
+			Value:  streaming.DefaultKafkaCompression,
+			Usage:  "The codec message batches are compressed with (options: none, gzip, snappy, lz4, zstd).",
+			EnvVar: envPrefix + "_COMPRESSION",
+		},
+		cli.IntFlag{
+			Name:   prefix + "." + FlagKafkaFlushBytes,
+			Usage:  "The number of bytes that triggers a flush. Disabled if 0.",
+			EnvVar: envPrefix + "_FLUSH_BYTES",
+		},
+		cli.IntFlag{
+			Name:   prefix + "." + FlagKafkaFlushMessages,
+			Usage:  "The number of messages that triggers a flush. Disabled if 0.",
+			EnvVar: envPrefix + "_FLUSH_MESSAGES",
+		},
+		cli.DurationFlag{
+			Name:   prefix + "." + FlagKafkaFlushFrequency,
+			Value:  streaming.DefaultKafkaFlushFrequency,
+			Usage:  "The interval messages are flushed at.",
+			EnvVar: envPrefix + "_FLUSH_FREQUENCY",
+		},
+		cli.IntFlag{
+			Name:   prefix + "." + FlagKafkaMaxMessageBytes,
+			Value:  streaming.DefaultKafkaMaxMessageBytes,
+			Usage:  "The maximum size of a message in bytes.",
+			EnvVar: envPrefix + "_MAX_MESSAGE_BYTES",
+		},
+		cli.DurationFlag{
+			Name:   prefix + "." + FlagKafkaRetryBackoff,
+			Value:  streaming.DefaultKafkaRetryBackoff,
+			Usage:  "The time to wait before retrying to produce a message.",
+			EnvVar: envPrefix + "_RETRY_BACKOFF",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaPartitioner,
+			Value:  streaming.DefaultKafkaPartitioner,
+			Usage:  "The partitioner of messages without an explicit partition (options: hash, random, round-robin, murmur2).",
+			EnvVar: envPrefix + "_PARTITIONER",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaClientID,
+			Usage:  "The client ID sent to the brokers. Defaults to 'sarama'.",
+			EnvVar: envPrefix + "_CLIENT_ID",
+		},
+		cli.BoolFlag{
+			Name:   prefix + "." + FlagKafkaIdempotent,
+			Usage:  "Use the idempotent producer, so retries do not duplicate messages. Requires acks 'all' and Kafka 0.11 or later.",
+			EnvVar: envPrefix + "_IDEMPOTENT",
+		},
+		cli.BoolFlag{
+			Name:   prefix + "." + FlagKafkaTLS,
+			Usage:  "Connect to the brokers with TLS. Enabled when a TLS file is set.",
+			EnvVar: envPrefix + "_TLS",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaTLSCA,
+			Usage:  "The PEM CA certificates file to verify the brokers with. Defaults to the system roots.",
+			EnvVar: envPrefix + "_TLS_CA",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaTLSCert,
+			Usage:  "The PEM client certificate file for mutual TLS.",
+			EnvVar: envPrefix + "_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaTLSKey,
+			Usage:  "The PEM client key file for mutual TLS.",
+			EnvVar: envPrefix + "_TLS_KEY",
+		},
+		cli.BoolFlag{
+			Name:   prefix + "." + FlagKafkaTLSInsecure,
+			Usage:  "Skip the verification of the broker certificates.",
+			EnvVar: envPrefix + "_TLS_INSECURE",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaSASLMechanism,
+			Usage:  "The SASL mechanism to authenticate with (options: plain, scram-sha-256, scram-sha-512). Disabled if empty.",
+			EnvVar: envPrefix + "_SASL_MECHANISM",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaSASLUser,
+			Usage:  "The SASL user.",
+			EnvVar: envPrefix + "_SASL_USER",
+		},
+		cli.StringFlag{
+			Name:   prefix + "." + FlagKafkaSASLPassword,
+			Usage:  "The SASL password.",
+			EnvVar: envPrefix + "_SASL_PASSWORD",
+		},
+	}
+}
+
 var commands = []cli.Command{
 	{
 		Name:  "server",
@@ -75,8 +543,13 @@ var commands = []cli.Command{
 		Flags: clix.Flags.Merge(
 			clix.CommonFlags,
 			clix.ServerFlags,
+			batchFlags,
+			ackFlags,
+			backpressureFlags,
 			s3Flags,
+			spoolFlags,
 			kafkaFlags,
+			secondaryKafkaFlags,
 			flags,
 		),
 		Action: runServer,
@@ -86,12 +559,39 @@ var commands = []cli.Command{
 		Usage: "Restore from S3",
 		Flags: clix.Flags.Merge(
 			clix.CommonFlags,
+			restoreFlags,
+			filterFlags,
+			restoredFlags,
 			s3Flags,
+			spoolFlags,
 			kafkaFlags,
 			flags,
 		),
 		Action: runRestore,
 	},
+	{
+		Name:  "inspect",
+		Usage: "Inspect the archived messages in S3",
+		Flags: clix.Flags.Merge(
+			clix.CommonFlags,
+			inspectFlags,
+			filterFlags,
+			restoredFlags,
+			s3Flags,
+		),
+		Action: runInspect,
+	},
+	{
+		Name:  "cleanup",
+		Usage: "Remove restored objects after their retention",
+		Flags: clix.Flags.Merge(
+			clix.CommonFlags,
+			cleanupFlags,
+			restoredFlags,
+			s3Flags,
+		),
+		Action: runCleanup,
+	},
 }
 
 func main() {
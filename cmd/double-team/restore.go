@@ -1,14 +1,18 @@
 package main
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/msales/double-team"
+	"github.com/msales/double-team/pkg/breaker"
 	"github.com/msales/double-team/streaming"
 	"github.com/msales/pkg/v3/clix"
 	"github.com/msales/pkg/v3/log"
 	"github.com/msales/pkg/v3/stats"
 	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -20,57 +24,291 @@ func runRestore(c *cli.Context) {
 
 	go stats.RuntimeFromContext(ctx, 10*time.Second)
 
-	kafkaProducer, err := newKafkaProducer(ctx)
+	filter, err := newFilter(ctx)
 	if err != nil {
 		log.Fatal(ctx, err.Error())
 	}
 
-	s3Producer, err := newS3Producer(ctx)
+	topics, err := newTopicMap(ctx)
 	if err != nil {
 		log.Fatal(ctx, err.Error())
 	}
 
-	app, err := newApplication(ctx, []streaming.Producer{kafkaProducer, s3Producer}, c.Int(FlagQueueSize))
+	if c.Bool(FlagRestoreDryRun) {
+		consumer, err := newConsumer(ctx, c.String(FlagRestoredRunID))
+		if err != nil {
+			log.Fatal(ctx, err.Error())
+		}
+
+		runDryRun(ctx, consumer, topics.Exclude(filter))
+		return
+	}
+
+	watch := c.Bool(FlagRestoreWatch)
+	if watch && c.String(FlagRestoreCheckpoint) != "" {
+		log.Fatal(ctx, "watch cannot be combined with a checkpoint")
+	}
+
+	// Messages that fail to reach Kafka are not re-archived, their object
+	// is kept in the source until every message has been acknowledged.
+	producers, queueSize, opts, err := newRestoreProducers(ctx)
 	if err != nil {
 		log.Fatal(ctx, err.Error())
 	}
 
-	s3Consumer, err := newS3Consumer(ctx)
+	app, err := newApplication(ctx, producers, queueSize, opts...)
 	if err != nil {
 		log.Fatal(ctx, err.Error())
 	}
 
-	log.Info(ctx, "Starting restore process")
+	r := &restorer{
+		ctx:      ctx,
+		app:      app,
+		producer: producers[0],
+		topics:   topics,
+		limiter:  newRateLimiter(c.Int(FlagRestoreRateMessages), c.Int(FlagRestoreRateBytes)),
+		runID:    c.String(FlagRestoredRunID),
+		stop:     make(chan struct{}),
+		newConsumer: func(runID string) (streaming.Consumer, error) {
+			return newConsumer(ctx, runID)
+		},
+	}
 
-	messages, errs := s3Consumer.Output(time.Now())
-	go func() {
-		for err := range errs {
-			log.Error(ctx, err.Error())
-		}
-	}()
+	if watch {
+		go func() {
+			<-clix.WaitForSignals()
+			close(r.stop)
+		}()
+
+		r.watch(c.Duration(FlagRestoreWatchInterval), c.Duration(FlagRestoreWatchStable))
+	} else {
+		_ = r.restore()
+	}
+
+	log.Info(ctx, "Draining queues")
+
+	// Close the application
+	if err := app.Close(); err != nil {
+		log.Error(ctx, err.Error())
+	}
+}
+
+// restoreApp is the application archived messages are sent to.
+type restoreApp interface {
+	SendMessage(ctx context.Context, msg *streaming.Message) error
+	IsHealthy() error
+}
+
+// restorer sends archived messages to Kafka.
+type restorer struct {
+	ctx      *clix.Context
+	app      restoreApp
+	producer streaming.Producer
+	topics   *streaming.TopicMap
+	limiter  *rateLimiter
+	runID    string
+	stop     chan struct{}
+
+	// newConsumer creates the consumer of a restore run.
+	newConsumer func(runID string) (streaming.Consumer, error)
+}
 
+// restore runs a restore of the archive. It stops early and returns an
+// error when the producers are not healthy.
+func (r *restorer) restore() error {
+	ctx := r.ctx
+
+	// The run ID identifies the restore on moved and tagged objects
+	runID := r.runID
+	if runID == "" {
+		runID = ksuid.New().String()
+	}
+
+	// The filter is created for each run, so that it ends at the run start
+	filter, err := newFilter(ctx)
+	if err != nil {
+		return err
+	}
+	filter = r.topics.Exclude(filter)
+
+	consumer, err := r.newConsumer(runID)
+	if err != nil {
+		return err
+	}
+
+	log.Info(ctx, "Starting restore process", "run", runID)
+
+	messages, errs := consumer.Output(filter)
+	go logErrors(ctx, errs)
+
+	// Messages are acknowledged or rejected once by the application
+	pending := sync.WaitGroup{}
+
+	var total int
+	var restoreErr error
+loop:
 	for msgs := range messages {
+		total += len(msgs)
+
 		for _, msg := range msgs {
-			app.Send(msg.Topic, msg.Key, msg.Data)
+			// Dropped topics are excluded by the filter and kept in the archive
+			msg.Topic, _ = r.topics.Map(msg.Topic)
+
+			_ = r.limiter.Wait(ctx, msg)
+
+			pending.Add(1)
+			ack, nack := msg.Ack, msg.Nack
+			msg.Ack = func(producer string) {
+				if ack != nil {
+					ack(producer)
+				}
+				pending.Done()
+			}
+			msg.Nack = func(err error) {
+				if nack != nil {
+					nack(err)
+				}
+				pending.Done()
+			}
+
+			// The context is never done, so the send waits for queue space
+			if err := r.app.SendMessage(ctx, msg); err != nil {
+				msg.Reject(err)
+				continue
+			}
 			stats.Inc(ctx, "consumed", 1, 1.0)
 		}
 
-		if err := shouldContinue(app, kafkaProducer); err != nil {
+		if restoreErr = shouldContinue(r.app, r.producer); restoreErr != nil {
 			break
 		}
+
+		select {
+		case <-r.stop:
+			break loop
+		default:
+		}
 	}
 
-	log.Info(ctx, "Draining queues")
+	// Close the consumer once all acknowledgements have been received
+	pending.Wait()
+	if err := consumer.Close(); err != nil {
+		log.Error(ctx, err.Error())
+	}
 
-	// Close the application
-	if err := app.Close(); err != nil {
+	log.Info(ctx, "Done", "run", runID, "objects", consumer.Objects(), "messages", total)
+
+	return restoreErr
+}
+
+// watch restores the archive whenever the producers have been healthy for
+// the stable period, checking their health at the interval, until stopped.
+// A restore is paused as soon as the producers degrade.
+func (r *restorer) watch(interval, stable time.Duration) {
+	ctx := r.ctx
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Info(ctx, "Watching producer health", "interval", interval, "stable", stable)
+
+	var since time.Time
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := shouldContinue(r.app, r.producer); err != nil {
+			if !since.IsZero() {
+				log.Info(ctx, "Producers not healthy, waiting", "reason", err.Error())
+			}
+			since = time.Time{}
+			continue
+		}
+
+		if since.IsZero() {
+			since = time.Now()
+		}
+		if time.Since(since) < stable {
+			continue
+		}
+
+		if err := r.restore(); err != nil {
+			log.Info(ctx, "Restore paused", "reason", err.Error())
+			stats.Inc(ctx, "restore.paused", 1, 1.0)
+			since = time.Time{}
+		}
+	}
+}
+
+// runDryRun reads the whole archive without sending or removing anything
+// and reports what a restore would replay.
+func runDryRun(ctx *clix.Context, consumer streaming.Consumer, filter streaming.Filter) {
+	log.Info(ctx, "Starting restore dry run")
+
+	messages, errs := consumer.Output(filter)
+	go logErrors(ctx, errs)
+
+	var total int
+	for msgs := range messages {
+		total += len(msgs)
+	}
+
+	if err := consumer.Close(); err != nil {
 		log.Error(ctx, err.Error())
 	}
 
-	log.Info(ctx, "Done")
+	log.Info(ctx, "Done", "objects", consumer.Objects(), "messages", total)
 }
 
-func shouldContinue(app *doubleteam.Application, p streaming.Producer) error {
+// newRestoreProducers creates the Kafka producers messages are restored to,
+// from the configuration file if set, or from the Kafka flags.
+func newRestoreProducers(c *clix.Context) ([]streaming.Producer, int, []doubleteam.OptFunc, error) {
+	path := c.String(FlagConfig)
+	if path == "" {
+		p, err := newKafkaProducer(c, FlagKafka)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return []streaming.Producer{p}, c.Int(FlagQueueSize), nil, nil
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	// Only the Kafka tiers are restored to, archive tiers are skipped
+	producers, sizes, err := cfg.newProducers("kafka")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if len(producers) == 0 {
+		return nil, 0, nil, errors.New("config " + path + ": no Kafka producers in the chain")
+	}
+
+	queueSize := c.Int(FlagQueueSize)
+	if cfg.Queue > 0 {
+		queueSize = cfg.Queue
+	}
+
+	return producers, queueSize, []doubleteam.OptFunc{doubleteam.WithQueueSizes(sizes...)}, nil
+}
+
+func logErrors(ctx *clix.Context, errs <-chan error) {
+	for err := range errs {
+		log.Error(ctx, err.Error())
+	}
+}
+
+// breakerStater is implemented by producers guarded by a circuit-breaker.
+type breakerStater interface {
+	BreakerState() breaker.State
+}
+
+func shouldContinue(app restoreApp, p streaming.Producer) error {
 	if err := app.IsHealthy(); err != nil {
 		return err
 	}
@@ -78,5 +316,10 @@ func shouldContinue(app *doubleteam.Application, p streaming.Producer) error {
 	if !p.IsHealthy() {
 		return errors.New("Producer " + p.Name() + " not healthy")
 	}
+
+	// A half-open breaker needs the restored messages as trial calls to close
+	if b, ok := p.(breakerStater); ok && b.BreakerState() == breaker.StateOpen {
+		return errors.New("Producer " + p.Name() + " breaker open")
+	}
 	return nil
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/msales/double-team/streaming"
+	"github.com/msales/pkg/v3/clix"
+	"github.com/msales/pkg/v3/log"
+	"github.com/msales/pkg/v3/stats"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestRestorer_WatchWaitsForStableProducers(t *testing.T) {
+	interval, stable := 5*time.Millisecond, 100*time.Millisecond
+
+	p := &watchProducer{}
+	p.setHealthy(true)
+	r, runs := newTestRestorer(t, p, &watchApp{}, nil)
+	r.runID = "run"
+
+	done := make(chan struct{})
+	go func() {
+		r.watch(interval, stable)
+		close(done)
+	}()
+
+	// a degradation before the stable period passed resets it
+	time.Sleep(50 * time.Millisecond)
+	p.setHealthy(false)
+	time.Sleep(30 * time.Millisecond)
+	assert.Empty(t, runs.get())
+	p.setHealthy(true)
+	recovered := time.Now()
+
+	assert.True(t, waitFor(time.Second, func() bool { return len(runs.get()) > 0 }), "no restore started")
+	close(r.stop)
+	<-done
+
+	first := runs.get()[0]
+	assert.Equal(t, "run", first.id)
+	assert.True(t, first.at.Sub(recovered) >= stable, "restore started %v after the producers recovered", first.at.Sub(recovered))
+}
+
+func TestRestorer_WatchPausesARunWhenProducersDegrade(t *testing.T) {
+	interval, stable := 5*time.Millisecond, 50*time.Millisecond
+
+	p := &watchProducer{}
+	p.setHealthy(true)
+	// the producer degrades as soon as the first message is sent
+	app := &watchApp{onSend: func() { p.setHealthy(false) }, degrade: 1}
+	batches := []streaming.Messages{{{Topic: "test"}}, {{Topic: "test"}}, {{Topic: "test"}}}
+	r, runs := newTestRestorer(t, p, app, batches)
+
+	done := make(chan struct{})
+	go func() {
+		r.watch(interval, stable)
+		close(done)
+	}()
+
+	assert.True(t, waitFor(time.Second, func() bool { return len(runs.get()) > 0 }), "no restore started")
+
+	// the run stops after the first batch and no other run starts
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(1), app.count())
+	assert.Len(t, runs.get(), 1)
+
+	atomic.StoreInt32(&app.degrade, 0)
+	p.setHealthy(true)
+	recovered := time.Now()
+
+	assert.True(t, waitFor(time.Second, func() bool { return app.count() >= 4 }), "restore did not resume")
+	close(r.stop)
+	<-done
+
+	got := runs.get()
+	assert.NotEqual(t, got[0].id, got[1].id)
+	assert.True(t, got[1].at.Sub(recovered) >= stable, "restore resumed %v after the producers recovered", got[1].at.Sub(recovered))
+}
+
+// newTestRestorer creates a restorer whose runs each consume the batches,
+// recording the run ID and start of each run.
+func newTestRestorer(t *testing.T, p streaming.Producer, app restoreApp, batches []streaming.Messages) (*restorer, *watchRuns) {
+	c, err := clix.NewContext(
+		cli.NewContext(nil, flag.NewFlagSet("test", flag.ContinueOnError), nil),
+		clix.WithLogger(log.Null),
+		clix.WithStats(stats.Null),
+	)
+	assert.NoError(t, err)
+
+	topics, err := streaming.NewTopicMap(nil, "", "")
+	assert.NoError(t, err)
+
+	runs := &watchRuns{}
+	return &restorer{
+		ctx:      c,
+		app:      app,
+		producer: p,
+		topics:   topics,
+		limiter:  newRateLimiter(0, 0),
+		stop:     make(chan struct{}),
+		newConsumer: func(runID string) (streaming.Consumer, error) {
+			runs.add(runID)
+			return newWatchConsumer(batches), nil
+		},
+	}, runs
+}
+
+// waitFor polls the condition until it holds or the timeout passes.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
+
+type watchRun struct {
+	id string
+	at time.Time
+}
+
+type watchRuns struct {
+	mu   sync.Mutex
+	runs []watchRun
+}
+
+func (r *watchRuns) add(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.runs = append(r.runs, watchRun{id: id, at: time.Now()})
+}
+
+func (r *watchRuns) get() []watchRun {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]watchRun(nil), r.runs...)
+}
+
+// watchApp acknowledges every message as it is sent, calling onSend for
+// each message while degrade is set.
+type watchApp struct {
+	sent    int64
+	degrade int32
+	onSend  func()
+}
+
+func (a *watchApp) SendMessage(ctx context.Context, msg *streaming.Message) error {
+	atomic.AddInt64(&a.sent, 1)
+	if atomic.LoadInt32(&a.degrade) == 1 {
+		a.onSend()
+	}
+	msg.Acknowledge("kafka")
+	return nil
+}
+
+func (a *watchApp) IsHealthy() error {
+	return nil
+}
+
+func (a *watchApp) count() int64 {
+	return atomic.LoadInt64(&a.sent)
+}
+
+// watchProducer is a producer whose health is set by the test.
+type watchProducer struct {
+	healthy int32
+}
+
+func (p *watchProducer) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&p.healthy, v)
+}
+
+func (p *watchProducer) Name() string {
+	return "kafka"
+}
+
+func (p *watchProducer) Input() chan<- *streaming.Message {
+	return nil
+}
+
+func (p *watchProducer) Errors() <-chan *streaming.Error {
+	return nil
+}
+
+func (p *watchProducer) Close() error {
+	return nil
+}
+
+func (p *watchProducer) IsHealthy() bool {
+	return atomic.LoadInt32(&p.healthy) == 1
+}
+
+// watchConsumer outputs copies of its batches until closed.
+type watchConsumer struct {
+	batches []streaming.Messages
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newWatchConsumer(batches []streaming.Messages) *watchConsumer {
+	return &watchConsumer{batches: batches, done: make(chan struct{})}
+}
+
+func (c *watchConsumer) Output(f streaming.Filter) (<-chan streaming.Messages, <-chan error) {
+	out := make(chan streaming.Messages)
+	errs := make(chan error)
+
+	go func() {
+		defer close(errs)
+		defer close(out)
+
+		for _, batch := range c.batches {
+			msgs := make(streaming.Messages, len(batch))
+			for i, msg := range batch {
+				m := *msg
+				msgs[i] = &m
+			}
+
+			select {
+			case out <- msgs:
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	return out, errs
+}
+
+func (c *watchConsumer) Objects() int {
+	return len(c.batches)
+}
+
+func (c *watchConsumer) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *watchConsumer) IsHealthy() bool {
+	return true
+}
@@ -6,10 +6,12 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/msales/double-team"
 	"github.com/msales/double-team/streaming"
 	"github.com/msales/pkg/v3/clix"
 	"github.com/msales/pkg/v3/log"
 	"github.com/msales/pkg/v3/stats"
+	"github.com/pkg/errors"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -21,17 +23,12 @@ func runServer(c *cli.Context) {
 
 	go stats.RuntimeFromContext(ctx, 10*time.Second)
 
-	kafkaProducer, err := newKafkaProducer(ctx)
-	if err != nil {
-		log.Fatal(ctx, err.Error())
-	}
-
-	s3Producer, err := newS3Producer(ctx)
-	if err != nil {
-		log.Fatal(ctx, err.Error())
+	var app *doubleteam.Application
+	if path := c.String(FlagConfig); path != "" {
+		app, err = newConfigApplication(ctx, path)
+	} else {
+		app, err = newFlagApplication(ctx)
 	}
-
-	app, err := newApplication(ctx, []streaming.Producer{kafkaProducer, s3Producer}, c.Int(FlagQueueSize))
 	if err != nil {
 		log.Fatal(ctx, err.Error())
 	}
@@ -65,3 +62,72 @@ func runServer(c *cli.Context) {
 
 	log.Info(ctx, "Server stopped gracefully")
 }
+
+// newConfigApplication creates the application from the producer chain
+// configuration file.
+func newConfigApplication(c *clix.Context, path string) (*doubleteam.Application, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	producers, sizes, err := cfg.newProducers()
+	if err != nil {
+		return nil, err
+	}
+
+	mirrors, err := cfg.newMirrors()
+	if err != nil {
+		return nil, err
+	}
+
+	queueSize := c.Int(FlagQueueSize)
+	if cfg.Queue > 0 {
+		queueSize = cfg.Queue
+	}
+
+	opts := append([]doubleteam.OptFunc{
+		doubleteam.WithQueueSizes(sizes...),
+		doubleteam.WithBlackHole(cfg.blackHole()),
+	}, mirrors...)
+
+	return newApplication(c, producers, queueSize, opts...)
+}
+
+// newFlagApplication creates the application from the producer flags.
+func newFlagApplication(c *clix.Context) (*doubleteam.Application, error) {
+	kafkaProducer, err := newKafkaProducer(c, FlagKafka)
+	if err != nil {
+		return nil, err
+	}
+
+	producers := []streaming.Producer{kafkaProducer}
+	if len(c.StringSlice(FlagKafkaSecondary+"."+FlagKafkaBrokers)) > 0 {
+		secondaryProducer, err := newKafkaProducer(c, FlagKafkaSecondary)
+		if err != nil {
+			return nil, err
+		}
+		if secondaryProducer.Name() == kafkaProducer.Name() {
+			return nil, errors.New("the Kafka producers must have different names")
+		}
+
+		producers = append(producers, secondaryProducer)
+	}
+
+	s3Producer, err := newS3Producer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	producers = append(producers, s3Producer)
+	if c.String(FlagSpoolDir) != "" {
+		spoolProducer, err := newSpoolProducer(c)
+		if err != nil {
+			return nil, err
+		}
+
+		producers = append(producers, spoolProducer)
+	}
+
+	return newApplication(c, producers, c.Int(FlagQueueSize))
+}
@@ -9,6 +9,7 @@ require (
 	github.com/go-zoo/bone v0.0.0-20160911183509-fd0aebc74e90
 	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8 // indirect
 	github.com/joho/godotenv v1.2.0
+	github.com/klauspost/compress v1.8.2
 	github.com/klauspost/cpuid v1.2.1 // indirect
 	github.com/magiconair/properties v1.8.0
 	github.com/mattn/go-colorable v0.0.9 // indirect
@@ -18,7 +19,11 @@ require (
 	github.com/segmentio/ksuid v1.0.1
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/stretchr/testify v1.3.0
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	github.com/xdg/stringprep v1.0.0 // indirect
+	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
 	gopkg.in/inconshreveable/log15.v2 v2.0.0-20171019012758-0decfc6c20d9
 	gopkg.in/ini.v1 v1.51.0 // indirect
 	gopkg.in/urfave/cli.v1 v1.20.0
+	gopkg.in/yaml.v2 v2.2.2
 )
@@ -13,45 +13,187 @@ var ErrBreakerOpen = errors.New("breaker: circuit breaker is open")
 const (
 	closed uint32 = iota
 	open
+	halfOpen
 )
 
+// State is the state of a Breaker.
+type State uint32
+
+// Breaker states.
+const (
+	StateClosed   = State(closed)
+	StateOpen     = State(open)
+	StateHalfOpen = State(halfOpen)
+)
+
+// String returns the name of the state.
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// OptFunc represents a configuration function for Breaker.
+type OptFunc func(b *Breaker)
+
+// WithTrialCalls sets the number of calls admitted while the breaker is half-open.
+func WithTrialCalls(n int) OptFunc {
+	return OptFunc(func(b *Breaker) {
+		b.trialCalls = n
+	})
+}
+
+// WithTrialTimeout sets the time the trial calls of a half-open breaker have
+// to succeed, from the first trial call, before the breaker opens again.
+// Defaults to the breaker timeout.
+func WithTrialTimeout(d time.Duration) OptFunc {
+	return OptFunc(func(b *Breaker) {
+		b.trialTimeout = d
+	})
+}
+
 // Breaker implements the circuit-breaker pattern.
+//
+// Once the timeout of an open breaker expires, the breaker becomes half-open
+// and admits a limited number of trial calls. The breaker closes when the
+// trial calls succeed and opens again on the first error, or when the trial
+// calls do not all succeed within the trial timeout. Only the outcomes of
+// the trial calls are taken into account while the breaker is half-open.
 type Breaker struct {
 	errorThreshold int
+	trialCalls     int
 	timeout        time.Duration
+	trialTimeout   time.Duration
+
+	lock       sync.Mutex
+	state      uint32
+	generation uint64
+	errors     int
+	trials     int
+	successes  int
+	lastError  time.Time
+}
 
-	lock      sync.Mutex
-	state     uint32
-	errors    int
-	lastError time.Time
+// Call is a call admitted by a Breaker. Its outcome is reported with
+// Success or Error.
+type Call struct {
+	b          *Breaker
+	generation uint64
+	trial      bool
 }
 
 // New creates a new Breaker.
-func New(errorThreshold int, timeout time.Duration) *Breaker {
-	return &Breaker{
+func New(errorThreshold int, timeout time.Duration, opts ...OptFunc) *Breaker {
+	b := &Breaker{
 		errorThreshold: errorThreshold,
+		trialCalls:     1,
 		timeout:        timeout,
+		trialTimeout:   timeout,
 	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b
 }
 
 // Run will run the given function or return ErrBreakerOpen immediately
-// if the circuit-breaker is open.
+// if the circuit-breaker is open. The outcome of the function is not
+// tracked; use Allow to report it.
 func (b *Breaker) Run(fn func()) error {
-	state := atomic.LoadUint32(&b.state)
-
-	if state == open {
-		return ErrBreakerOpen
+	if _, err := b.Allow(); err != nil {
+		return err
 	}
 
 	fn()
 	return nil
 }
 
-// Error registers an error with the circuit-breaker, potentially opening the breaker.
+// Allow admits a call, or returns ErrBreakerOpen if the circuit-breaker is
+// open or the trial calls of a half-open breaker have all been admitted.
+func (b *Breaker) Allow() (*Call, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case closed:
+		return &Call{b: b, generation: b.generation}, nil
+	case halfOpen:
+		if b.trials < b.trialCalls {
+			if b.trials == 0 {
+				// Trial calls that never report back open the breaker again
+				go b.timer(b.generation, b.trialTimeout, open)
+			}
+			b.trials++
+			return &Call{b: b, generation: b.generation, trial: true}, nil
+		}
+	}
+	return nil, ErrBreakerOpen
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	return State(atomic.LoadUint32(&b.state))
+}
+
+// Error registers an error of a call admitted with Run, potentially opening
+// a closed breaker. It is ignored unless the breaker is closed, as it
+// cannot be told apart from the late error of a call made before the
+// breaker opened.
 func (b *Breaker) Error() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
+	if b.state == closed {
+		b.registerError()
+	}
+}
+
+// Success reports that the call succeeded, closing a half-open breaker once
+// all its trial calls have succeeded.
+func (c *Call) Success() {
+	b := c.b
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !c.trial || c.generation != b.generation {
+		return
+	}
+
+	b.successes++
+	if b.successes >= b.trialCalls {
+		b.changeState(closed)
+	}
+}
+
+// Error reports that the call failed, potentially opening the breaker. A
+// failed trial call opens a half-open breaker again. Errors of calls made
+// before the breaker last changed state are ignored.
+func (c *Call) Error() {
+	b := c.b
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if c.generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case halfOpen:
+		b.openBreaker()
+	case closed:
+		b.registerError()
+	}
+}
+
+func (b *Breaker) registerError() {
 	if b.errors > 0 {
 		expiry := b.lastError.Add(b.timeout)
 		if time.Now().After(expiry) {
@@ -59,31 +201,43 @@ func (b *Breaker) Error() {
 		}
 	}
 
-	if b.state == closed {
-		b.errors++
-		if b.errors == b.errorThreshold {
-			b.openBreaker()
-		} else {
-			b.lastError = time.Now()
-		}
+	b.errors++
+	if b.errors == b.errorThreshold {
+		b.openBreaker()
+	} else {
+		b.lastError = time.Now()
 	}
 }
 
 func (b *Breaker) openBreaker() {
 	b.changeState(open)
-	go b.timer()
+	go b.timer(b.generation, b.timeout, halfOpen)
 }
 
-func (b *Breaker) timer() {
-	time.Sleep(b.timeout)
+// timer changes the state of the breaker after d, unless it has changed in
+// the meantime.
+func (b *Breaker) timer(generation uint64, d time.Duration, newState uint32) {
+	time.Sleep(d)
 
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.changeState(closed)
+	if b.generation != generation {
+		return
+	}
+
+	if newState == open {
+		b.openBreaker()
+		return
+	}
+
+	b.changeState(newState)
 }
 
 func (b *Breaker) changeState(newState uint32) {
+	b.generation++
 	b.errors = 0
+	b.trials = 0
+	b.successes = 0
 	atomic.StoreUint32(&b.state, newState)
 }
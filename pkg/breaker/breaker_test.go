@@ -46,3 +46,107 @@ func TestBreakerStateTransitions(t *testing.T) {
 	err = b.Run(func() {})
 	assert.NoError(t, err)
 }
+
+func TestBreakerHalfOpenLimitsTrialCalls(t *testing.T) {
+	b := breaker.New(1, 100*time.Millisecond, breaker.WithTrialCalls(2))
+
+	b.Error()
+	time.Sleep(150 * time.Millisecond)
+
+	// Breaker is half-open
+	assert.NoError(t, b.Run(func() {}))
+	assert.NoError(t, b.Run(func() {}))
+	assert.Equal(t, breaker.ErrBreakerOpen, b.Run(func() {}))
+}
+
+func TestBreakerHalfOpenClosesOnSuccess(t *testing.T) {
+	b := breaker.New(1, 100*time.Millisecond, breaker.WithTrialCalls(2))
+
+	b.Error()
+	time.Sleep(150 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		call, err := b.Allow()
+		assert.NoError(t, err)
+		call.Success()
+	}
+
+	// Breaker is closed
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, b.Run(func() {}))
+	}
+}
+
+func TestBreakerHalfOpenReopensOnError(t *testing.T) {
+	b := breaker.New(1, 100*time.Millisecond, breaker.WithTrialCalls(2))
+
+	b.Error()
+	time.Sleep(150 * time.Millisecond)
+
+	first, err := b.Allow()
+	assert.NoError(t, err)
+	second, err := b.Allow()
+	assert.NoError(t, err)
+	first.Success()
+	second.Error()
+
+	// Breaker is open
+	assert.Equal(t, breaker.ErrBreakerOpen, b.Run(func() {}))
+}
+
+func TestBreakerState(t *testing.T) {
+	b := breaker.New(2, 100*time.Millisecond)
+	assert.Equal(t, breaker.StateClosed, b.State())
+
+	b.Error()
+	b.Error()
+	assert.Equal(t, breaker.StateOpen, b.State())
+	assert.Equal(t, "open", b.State().String())
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, breaker.StateHalfOpen, b.State())
+
+	call, _ := b.Allow()
+	call.Success()
+	assert.Equal(t, breaker.StateClosed, b.State())
+}
+
+func TestBreakerHalfOpenIgnoresLateOutcomes(t *testing.T) {
+	b := breaker.New(1, 100*time.Millisecond)
+
+	late, err := b.Allow()
+	assert.NoError(t, err)
+	b.Error()
+	time.Sleep(150 * time.Millisecond)
+
+	// Breaker is half-open
+	late.Success()
+	assert.Equal(t, breaker.StateHalfOpen, b.State())
+	late.Error()
+	assert.Equal(t, breaker.StateHalfOpen, b.State())
+	b.Error()
+	assert.Equal(t, breaker.StateHalfOpen, b.State())
+
+	call, err := b.Allow()
+	assert.NoError(t, err)
+	call.Success()
+	assert.Equal(t, breaker.StateClosed, b.State())
+}
+
+func TestBreakerHalfOpenReopensOnTrialTimeout(t *testing.T) {
+	b := breaker.New(1, 100*time.Millisecond, breaker.WithTrialTimeout(50*time.Millisecond))
+
+	b.Error()
+	time.Sleep(120 * time.Millisecond)
+
+	// Breaker is half-open, and the trial call never reports back
+	_, err := b.Allow()
+	assert.NoError(t, err)
+	assert.Equal(t, breaker.StateHalfOpen, b.State())
+
+	time.Sleep(80 * time.Millisecond)
+	assert.Equal(t, breaker.StateOpen, b.State())
+
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, breaker.StateHalfOpen, b.State())
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/msales/double-team/streaming"
+)
+
+// Acknowledgement modes.
+const (
+	// AckHeader is the request header selecting the acknowledgement mode.
+	AckHeader = "X-Ack"
+	// AckParam is the query parameter selecting the acknowledgement mode.
+	AckParam = "ack"
+
+	ackSync  = "sync"
+	ackAsync = "async"
+)
+
+var errAckTimeout = errors.New("server: timed out waiting for acknowledgement")
+
+// isSync determines if the request waits for its messages to be stored.
+// The request header takes precedence over the query parameter, which
+// takes precedence over the server default.
+func (s *Server) isSync(r *http.Request) bool {
+	mode := r.Header.Get(AckHeader)
+	if mode == "" {
+		mode = r.URL.Query().Get(AckParam)
+	}
+
+	switch strings.ToLower(mode) {
+	case ackSync:
+		return true
+	case ackAsync:
+		return false
+	default:
+		return s.syncAck
+	}
+}
+
+// delivery tracks the outcome of a sent message.
+type delivery struct {
+	producer chan string
+	err      chan error
+}
+
+func newDelivery(msg *streaming.Message) *delivery {
+	d := &delivery{
+		producer: make(chan string, 1),
+		err:      make(chan error, 1),
+	}
+
+	msg.Ack = func(producer string) {
+		select {
+		case d.producer <- producer:
+		default:
+		}
+	}
+	msg.Nack = func(err error) {
+		select {
+		case d.err <- err:
+		default:
+		}
+	}
+
+	return d
+}
+
+// wait blocks until the message is stored, dropped or the context is done.
+func (d *delivery) wait(ctx context.Context) (string, error) {
+	select {
+	case producer := <-d.producer:
+		return producer, nil
+	case err := <-d.err:
+		return "", err
+	case <-ctx.Done():
+		return "", errAckTimeout
+	}
+}
@@ -1,34 +1,146 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/go-zoo/bone"
+	"github.com/msales/double-team/streaming"
 )
 
 // Application represents the main application.
 type Application interface {
-	// Send produces a message with fallback.
-	Send(topic string, key, data []byte)
+	// SendMessage produces a message with fallback. It returns a temporary
+	// error if the message could not be queued before the context is done,
+	// and another error if the message cannot be queued at all for now.
+	SendMessage(ctx context.Context, msg *streaming.Message) error
 	// IsHealthy checks the health of the Application.
 	IsHealthy() error
 }
 
+// degraded is implemented by health errors of an Application that
+// still accepts messages.
+type degraded interface {
+	Degraded() bool
+}
+
+func isDegraded(err error) bool {
+	d, ok := err.(degraded)
+	return ok && d.Degraded()
+}
+
+// temporary is implemented by errors of an Application whose queue is
+// saturated, so that the message may be queued when retried.
+type temporary interface {
+	Temporary() bool
+}
+
+func isTemporary(err error) bool {
+	t, ok := err.(temporary)
+	return ok && t.Temporary()
+}
+
+// Batch defaults.
+const (
+	DefaultBatchMaxRecords       = 1000
+	DefaultBatchMaxBytes   int64 = 10 << 20
+)
+
+// DefaultAckTimeout is the default time a synchronous request waits for its messages to be stored.
+const DefaultAckTimeout = 10 * time.Second
+
+// Backpressure defaults.
+const (
+	DefaultQueueTimeout = 100 * time.Millisecond
+	DefaultRetryAfter   = time.Second
+)
+
+// OptFunc represents a configuration function for Server.
+type OptFunc func(s *Server)
+
+// WithBatchMaxRecords sets the maximum number of records accepted in a batch request.
+func WithBatchMaxRecords(n int) OptFunc {
+	return OptFunc(func(s *Server) {
+		s.batchMaxRecords = n
+	})
+}
+
+// WithBatchMaxBytes sets the maximum body size of a batch request.
+func WithBatchMaxBytes(n int64) OptFunc {
+	return OptFunc(func(s *Server) {
+		s.batchMaxBytes = n
+	})
+}
+
+// WithSyncAck sets whether requests wait for their messages to be stored
+// unless the request selects an acknowledgement mode itself.
+func WithSyncAck(sync bool) OptFunc {
+	return OptFunc(func(s *Server) {
+		s.syncAck = sync
+	})
+}
+
+// WithAckTimeout sets the time a synchronous request waits for its messages to be stored.
+func WithAckTimeout(d time.Duration) OptFunc {
+	return OptFunc(func(s *Server) {
+		s.ackTimeout = d
+	})
+}
+
+// WithQueueTimeout sets the time a request waits for queue space before it is
+// refused with a 429 status code. A zero timeout refuses requests immediately.
+func WithQueueTimeout(d time.Duration) OptFunc {
+	return OptFunc(func(s *Server) {
+		s.queueTimeout = d
+	})
+}
+
+// WithRetryAfter sets the Retry-After advertised to clients refused with a 429 status code.
+func WithRetryAfter(d time.Duration) OptFunc {
+	return OptFunc(func(s *Server) {
+		s.retryAfter = d
+	})
+}
+
 // Server represents a http server handler.
 type Server struct {
 	app Application
 	mux *bone.Mux
+
+	batchMaxRecords int
+	batchMaxBytes   int64
+	syncAck         bool
+	ackTimeout      time.Duration
+	queueTimeout    time.Duration
+	retryAfter      time.Duration
 }
 
 // New creates a new Server instance.
-func New(app Application) *Server {
+func New(app Application, opts ...OptFunc) *Server {
 	s := &Server{
-		app: app,
-		mux: bone.New(),
+		app:             app,
+		mux:             bone.New(),
+		batchMaxRecords: DefaultBatchMaxRecords,
+		batchMaxBytes:   DefaultBatchMaxBytes,
+		ackTimeout:      DefaultAckTimeout,
+		queueTimeout:    DefaultQueueTimeout,
+		retryAfter:      DefaultRetryAfter,
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	s.mux.PostFunc("/", s.SendMessageHandler)
+	s.mux.PostFunc("/batch", s.SendBatchHandler)
 
 	s.mux.GetFunc("/health", s.HealthHandler)
 	s.mux.NotFound(NotFoundHandler())
@@ -43,14 +155,92 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type produceMessage struct {
-	Topic string `json:"topic"`
-	Key   string `json:"key"`
-	Data  string `json:"data"`
+	Topic     string         `json:"topic"`
+	Key       string         `json:"key"`
+	Data      string         `json:"data"`
+	Headers   produceHeaders `json:"headers"`
+	Partition *int32         `json:"partition"`
+	Timestamp *time.Time     `json:"timestamp"`
+}
+
+// produceHeaders are the headers of a message. They are given either as an
+// array of {"key", "value"} objects, kept in order with repeated keys, or as
+// an object, sorted by key.
+type produceHeaders []streaming.Header
+
+func (h *produceHeaders) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		var list []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}
+		if err := json.Unmarshal(b, &list); err != nil {
+			return err
+		}
+
+		*h = nil
+		for _, header := range list {
+			*h = append(*h, streaming.Header{Key: header.Key, Value: []byte(header.Value)})
+		}
+		return nil
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	*h = nil
+	for _, k := range keys {
+		*h = append(*h, streaming.Header{Key: k, Value: []byte(m[k])})
+	}
+	return nil
+}
+
+// validate returns the reason the message is invalid, if any.
+func (m produceMessage) validate() string {
+	if m.Topic == "" {
+		return "missing topic"
+	}
+
+	if m.Partition != nil && *m.Partition < 0 {
+		return "invalid partition"
+	}
+
+	return ""
+}
+
+func (m produceMessage) message() *streaming.Message {
+	msg := &streaming.Message{
+		Topic:     m.Topic,
+		Key:       []byte(m.Key),
+		Data:      []byte(m.Data),
+		Partition: m.Partition,
+	}
+
+	if m.Timestamp != nil {
+		msg.Timestamp = *m.Timestamp
+	}
+
+	if len(m.Headers) > 0 {
+		msg.Headers = m.Headers
+	}
+
+	return msg
 }
 
 // SendMessageHandler handles requests to send a message.
+//
+// In synchronous mode the handler waits until a producer has stored the
+// message and responds with the name of that producer.
 func (s *Server) SendMessageHandler(w http.ResponseWriter, r *http.Request) {
-	if err := s.app.IsHealthy(); err != nil {
+	if err := s.app.IsHealthy(); err != nil && !isDegraded(err) {
 		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
@@ -63,24 +253,260 @@ func (s *Server) SendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if msg.Topic == "" {
+	if msg.validate() != "" {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	s.app.Send(msg.Topic, []byte(msg.Key), []byte(msg.Data))
+	m := msg.message()
+	sync := s.isSync(r)
+
+	var d *delivery
+	if sync {
+		d = newDelivery(m)
+	}
+
+	queueCtx, cancel := context.WithTimeout(r.Context(), s.queueTimeout)
+	defer cancel()
+
+	if err := s.app.SendMessage(queueCtx, m); err != nil {
+		if r.Context().Err() != nil {
+			// the client is gone, there is no one to answer
+			return
+		}
+
+		code, reason := queueError(err)
+		if code == http.StatusTooManyRequests {
+			s.tooManyRequests(w)
+			return
+		}
+
+		http.Error(w, reason, code)
+		return
+	}
 
-	w.WriteHeader(200)
+	if !sync {
+		w.WriteHeader(200)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.ackTimeout)
+	defer cancel()
+
+	producer, err := d.wait(ctx)
+	switch {
+	case err == errAckTimeout:
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	default:
+		writeJSON(w, http.StatusOK, produceResult{Status: statusStored, Producer: producer})
+	}
 }
 
-// HealthHandler handles health requests.
-func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
-	if err := s.app.IsHealthy(); err != nil {
+// Record statuses.
+const (
+	statusAccepted = "accepted"
+	statusRejected = "rejected"
+	statusStored   = "stored"
+	statusFailed   = "failed"
+)
+
+type produceResult struct {
+	Status   string `json:"status"`
+	Producer string `json:"producer,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type batchResponse struct {
+	Accepted int             `json:"accepted"`
+	Rejected int             `json:"rejected"`
+	Stored   int             `json:"stored,omitempty"`
+	Failed   int             `json:"failed,omitempty"`
+	Results  []produceResult `json:"results"`
+}
+
+// SendBatchHandler handles requests to send a batch of messages.
+//
+// The body is either a JSON array of messages or newline delimited JSON
+// messages. Each record is validated independently and the result of
+// every record is returned in request order. In synchronous mode accepted
+// records are reported as stored or failed once their outcome is known.
+// Records that cannot be queued are rejected and the response has a 429
+// status code, or a 503 status code if the producer chain is failing.
+func (s *Server) SendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.app.IsHealthy(); err != nil && !isDegraded(err) {
 		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.batchMaxBytes+1))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > s.batchMaxBytes {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	records, err := splitBatch(body)
+	if err != nil || len(records) == 0 {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if len(records) > s.batchMaxRecords {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sync := s.isSync(r)
+	deliveries := make([]*delivery, len(records))
+
+	queueCtx, cancel := context.WithTimeout(r.Context(), s.queueTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+
+	resp := batchResponse{Results: make([]produceResult, len(records))}
+	for i, rec := range records {
+		msg := produceMessage{}
+		if err := json.Unmarshal(rec, &msg); err != nil {
+			resp.Rejected++
+			resp.Results[i] = produceResult{Status: statusRejected, Reason: "invalid json"}
+			continue
+		}
+
+		if reason := msg.validate(); reason != "" {
+			resp.Rejected++
+			resp.Results[i] = produceResult{Status: statusRejected, Reason: reason}
+			continue
+		}
+
+		m := msg.message()
+		var d *delivery
+		if sync {
+			d = newDelivery(m)
+		}
+
+		if err := s.app.SendMessage(queueCtx, m); err != nil {
+			if r.Context().Err() != nil {
+				// the client is gone, there is no one to answer
+				return
+			}
+
+			code, reason := queueError(err)
+			if status != http.StatusServiceUnavailable {
+				status = code
+			}
+			resp.Rejected++
+			resp.Results[i] = produceResult{Status: statusRejected, Reason: reason}
+			continue
+		}
+
+		deliveries[i] = d
+		resp.Accepted++
+		resp.Results[i] = produceResult{Status: statusAccepted}
+	}
+
+	if sync {
+		ctx, cancel := context.WithTimeout(r.Context(), s.ackTimeout)
+		defer cancel()
+
+		for i, d := range deliveries {
+			if d == nil {
+				continue
+			}
+
+			producer, err := d.wait(ctx)
+			if err != nil {
+				resp.Failed++
+				resp.Results[i] = produceResult{Status: statusFailed, Reason: err.Error()}
+				continue
+			}
+
+			resp.Stored++
+			resp.Results[i] = produceResult{Status: statusStored, Producer: producer}
+		}
+	}
+
+	if status == http.StatusTooManyRequests {
+		s.setRetryAfter(w)
+	}
+
+	writeJSON(w, status, resp)
+}
+
+// queueError gets the status code and reason of a message that could not
+// be queued. Only a saturated queue is worth retrying after a delay.
+func queueError(err error) (int, string) {
+	if isTemporary(err) {
+		return http.StatusTooManyRequests, "queue full"
+	}
+	return http.StatusServiceUnavailable, err.Error()
+}
+
+// tooManyRequests refuses a request because the queue is saturated.
+func (s *Server) tooManyRequests(w http.ResponseWriter) {
+	s.setRetryAfter(w)
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+func (s *Server) setRetryAfter(w http.ResponseWriter) {
+	secs := int(math.Ceil(s.retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// splitBatch splits a batch body into its raw records. A body starting
+// with '[' is treated as a JSON array, anything else as NDJSON.
+func splitBatch(body []byte) ([]json.RawMessage, error) {
+	body = bytes.TrimSpace(body)
+
+	if len(body) > 0 && body[0] == '[' {
+		var records []json.RawMessage
+		if err := json.Unmarshal(body, &records); err != nil {
+			return nil, err
+		}
+		return records, nil
+	}
+
+	var records []json.RawMessage
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		records = append(records, json.RawMessage(line))
+	}
+	return records, nil
+}
+
+// HealthHandler handles health requests.
+//
+// A degraded Application is reported with a 200 status code and a
+// "degraded" body, a failed Application with a 503 status code.
+func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.app.IsHealthy()
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+
+	case isDegraded(err):
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("degraded"))
+
+	default:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}
 }
 
 // NotFoundHandler returns a 404.
@@ -1,13 +1,17 @@
 package server_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/msales/double-team/server"
+	"github.com/msales/double-team/streaming"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,14 +23,17 @@ func TestServer_SendMessageHandler(t *testing.T) {
 	}{
 		{"{\"topic\":\"test\",\"data\":\"test\"}", nil, http.StatusOK},
 		{"{\"data\":\"test\"}", nil, http.StatusBadRequest},
+		{"{\"topic\":\"test\",\"partition\":-1}", nil, http.StatusBadRequest},
+		{"{\"topic\":\"test\",\"timestamp\":\"yesterday\"}", nil, http.StatusBadRequest},
 		{"{\"topic\":\"\"}", nil, http.StatusBadRequest},
 		{"hello", nil, http.StatusBadRequest},
 		{"", errors.New(""), http.StatusServiceUnavailable},
+		{"{\"topic\":\"test\",\"data\":\"test\"}", degradedError{}, http.StatusOK},
 	}
 
 	for _, tt := range tests {
 		app := testApp{
-			send: func(topic string, key, data []byte) {},
+			send: func(msg *streaming.Message) {},
 			isHealthy: func() error {
 				return tt.err
 			},
@@ -41,13 +48,292 @@ func TestServer_SendMessageHandler(t *testing.T) {
 	}
 }
 
+func TestServer_SendMessageHandlerWithMetadata(t *testing.T) {
+	var got *streaming.Message
+	app := testApp{
+		send: func(msg *streaming.Message) {
+			got = msg
+		},
+		isHealthy: func() error {
+			return nil
+		},
+	}
+	srv := server.New(app)
+
+	body := `{"topic":"test","key":"key","data":"data","headers":{"b":"2","a":"1"},"partition":3,"timestamp":"2020-01-02T03:04:05Z"}`
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	srv.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "test", got.Topic)
+		assert.Equal(t, []byte("key"), got.Key)
+		assert.Equal(t, []byte("data"), got.Data)
+		assert.Equal(t, []streaming.Header{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}}, got.Headers)
+		assert.Equal(t, int32(3), *got.Partition)
+		assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), got.Timestamp)
+	}
+}
+
+func TestServer_SendMessageHandlerWithOrderedHeaders(t *testing.T) {
+	var got *streaming.Message
+	app := testApp{
+		send: func(msg *streaming.Message) {
+			got = msg
+		},
+		isHealthy: func() error {
+			return nil
+		},
+	}
+	srv := server.New(app)
+
+	body := `{"topic":"test","headers":[{"key":"b","value":"2"},{"key":"a","value":"1"},{"key":"b","value":"3"}]}`
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	srv.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.NotNil(t, got) {
+		assert.Equal(t, []streaming.Header{
+			{Key: "b", Value: []byte("2")},
+			{Key: "a", Value: []byte("1")},
+			{Key: "b", Value: []byte("3")},
+		}, got.Headers)
+	}
+
+	body = `{"topic":"test","headers":"route"}`
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	srv.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_SendMessageHandlerSync(t *testing.T) {
+	tests := []struct {
+		target string
+		header string
+		sync   bool
+		send   func(msg *streaming.Message)
+		code   int
+		body   string
+	}{
+		{"/?ack=sync", "", false, func(msg *streaming.Message) { msg.Acknowledge("kafka") }, http.StatusOK, "{\"status\":\"stored\",\"producer\":\"kafka\"}\n"},
+		{"/", "sync", false, func(msg *streaming.Message) { msg.Acknowledge("s3") }, http.StatusOK, "{\"status\":\"stored\",\"producer\":\"s3\"}\n"},
+		{"/", "", true, func(msg *streaming.Message) { msg.Reject(errors.New("test")) }, http.StatusServiceUnavailable, "Service Unavailable\n"},
+		{"/", "", true, func(msg *streaming.Message) {}, http.StatusGatewayTimeout, "Gateway Timeout\n"},
+		{"/", "async", true, func(msg *streaming.Message) {}, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		app := testApp{
+			send: tt.send,
+			isHealthy: func() error {
+				return nil
+			},
+		}
+		srv := server.New(app, server.WithSyncAck(tt.sync), server.WithAckTimeout(10*time.Millisecond))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", tt.target, strings.NewReader("{\"topic\":\"test\"}"))
+		if tt.header != "" {
+			req.Header.Set(server.AckHeader, tt.header)
+		}
+		srv.ServeHTTP(w, req)
+
+		assert.Equal(t, tt.code, w.Code)
+		assert.Equal(t, tt.body, w.Body.String())
+	}
+}
+
+func TestServer_SendBatchHandlerSync(t *testing.T) {
+	app := testApp{
+		send: func(msg *streaming.Message) {
+			switch string(msg.Key) {
+			case "kafka":
+				msg.Acknowledge("kafka")
+			case "drop":
+				msg.Reject(errors.New("dropped"))
+			}
+		},
+		isHealthy: func() error {
+			return nil
+		},
+	}
+	srv := server.New(app, server.WithAckTimeout(10*time.Millisecond))
+
+	body := `[{"topic":"test","key":"kafka"},{"topic":"test","key":"drop"},{"key":"invalid"},{"topic":"test","key":"lost"}]`
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/batch?ack=sync", strings.NewReader(body))
+	srv.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"accepted": 3,
+		"rejected": 1,
+		"stored": 1,
+		"failed": 2,
+		"results": [
+			{"status": "stored", "producer": "kafka"},
+			{"status": "failed", "reason": "dropped"},
+			{"status": "rejected", "reason": "missing topic"},
+			{"status": "failed", "reason": "server: timed out waiting for acknowledgement"}
+		]
+	}`, w.Body.String())
+}
+
+func TestServer_Backpressure(t *testing.T) {
+	tests := []struct {
+		target string
+		body   string
+	}{
+		{"/", "{\"topic\":\"test\"}"},
+		{"/?ack=sync", "{\"topic\":\"test\"}"},
+		{"/batch", "[{\"topic\":\"test\"}]"},
+	}
+
+	for _, tt := range tests {
+		app := testApp{
+			isHealthy: func() error {
+				return nil
+			},
+			queueFull: true,
+		}
+		srv := server.New(app, server.WithRetryAfter(2500*time.Millisecond))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		srv.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "3", w.Header().Get("Retry-After"))
+	}
+}
+
+func TestServer_Unavailable(t *testing.T) {
+	tests := []struct {
+		target string
+		body   string
+		want   string
+	}{
+		{"/", "{\"topic\":\"test\"}", "producer chain failing\n"},
+		{"/?ack=sync", "{\"topic\":\"test\"}", "producer chain failing\n"},
+		{"/batch", "[{\"topic\":\"test\"}]", `{"accepted":0,"rejected":1,"results":[{"status":"rejected","reason":"producer chain failing"}]}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		app := testApp{
+			isHealthy: func() error {
+				return nil
+			},
+			sendErr: errors.New("producer chain failing"),
+		}
+		srv := server.New(app, server.WithRetryAfter(2500*time.Millisecond))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		srv.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "", w.Header().Get("Retry-After"))
+		assert.Equal(t, tt.want, w.Body.String())
+	}
+}
+
+func TestServer_ClientGone(t *testing.T) {
+	tests := []struct {
+		target string
+		body   string
+	}{
+		{"/", "{\"topic\":\"test\"}"},
+		{"/batch", "[{\"topic\":\"test\"}]"},
+	}
+
+	for _, tt := range tests {
+		app := testApp{
+			isHealthy: func() error {
+				return nil
+			},
+			queueFull: true,
+		}
+		srv := server.New(app)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body)).WithContext(ctx)
+		srv.ServeHTTP(w, req)
+
+		assert.Equal(t, "", w.Header().Get("Retry-After"))
+		assert.Equal(t, "", w.Body.String())
+	}
+}
+
+func TestServer_SendBatchHandler(t *testing.T) {
+	tests := []struct {
+		body     string
+		err      error
+		code     int
+		accepted int
+		rejected int
+	}{
+		{"[{\"topic\":\"test\",\"data\":\"test\"},{\"data\":\"test\"}]", nil, http.StatusOK, 1, 1},
+		{"{\"topic\":\"test\",\"data\":\"test\"}\nhello\n\n{\"topic\":\"test\"}\n", nil, http.StatusOK, 2, 1},
+		{"[{\"topic\":\"test\"},{\"topic\":\"test\"},{\"topic\":\"test\"},{\"topic\":\"test\"}]", nil, http.StatusRequestEntityTooLarge, 0, 0},
+		{"[{\"topic\":\"test\",\"data\":\"" + strings.Repeat("a", 100) + "\"}]", nil, http.StatusRequestEntityTooLarge, 0, 0},
+		{"[{\"topic\":\"test\"", nil, http.StatusBadRequest, 0, 0},
+		{"", nil, http.StatusBadRequest, 0, 0},
+		{"", errors.New(""), http.StatusServiceUnavailable, 0, 0},
+	}
+
+	for _, tt := range tests {
+		sent := 0
+		app := testApp{
+			send: func(msg *streaming.Message) {
+				sent++
+			},
+			isHealthy: func() error {
+				return tt.err
+			},
+		}
+		srv := server.New(app, server.WithBatchMaxRecords(3), server.WithBatchMaxBytes(100))
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/batch", strings.NewReader(tt.body))
+		srv.ServeHTTP(w, req)
+
+		assert.Equal(t, tt.code, w.Code)
+		assert.Equal(t, tt.accepted, sent)
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		var resp struct {
+			Accepted int `json:"accepted"`
+			Rejected int `json:"rejected"`
+			Results  []struct {
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+			} `json:"results"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, tt.accepted, resp.Accepted)
+		assert.Equal(t, tt.rejected, resp.Rejected)
+		assert.Len(t, resp.Results, tt.accepted+tt.rejected)
+	}
+}
+
 func TestServer_HealthHandler(t *testing.T) {
 	tests := []struct {
 		err  error
 		code int
+		body string
 	}{
-		{nil, http.StatusOK},
-		{errors.New(""), http.StatusServiceUnavailable},
+		{nil, http.StatusOK, ""},
+		{degradedError{}, http.StatusOK, "degraded"},
+		{errors.New(""), http.StatusServiceUnavailable, "Service Unavailable\n"},
 	}
 
 	for _, tt := range tests {
@@ -63,6 +349,7 @@ func TestServer_HealthHandler(t *testing.T) {
 		srv.ServeHTTP(w, req)
 
 		assert.Equal(t, tt.code, w.Code)
+		assert.Equal(t, tt.body, w.Body.String())
 	}
 }
 
@@ -75,14 +362,44 @@ func TestNotFoundHandler(t *testing.T) {
 }
 
 type testApp struct {
-	send      func(topic string, key, data []byte)
+	send      func(msg *streaming.Message)
 	isHealthy func() error
+	queueFull bool
+	sendErr   error
 }
 
-func (a testApp) Send(topic string, key, data []byte) {
-	a.send(topic, key, data)
+func (a testApp) SendMessage(ctx context.Context, msg *streaming.Message) error {
+	if a.queueFull {
+		return queueFullError{}
+	}
+	if a.sendErr != nil {
+		return a.sendErr
+	}
+
+	a.send(msg)
+	return nil
 }
 
 func (a testApp) IsHealthy() error {
 	return a.isHealthy()
 }
+
+type queueFullError struct{}
+
+func (queueFullError) Error() string {
+	return "queue full"
+}
+
+func (queueFullError) Temporary() bool {
+	return true
+}
+
+type degradedError struct{}
+
+func (degradedError) Error() string {
+	return "degraded"
+}
+
+func (degradedError) Degraded() bool {
+	return true
+}
@@ -0,0 +1,209 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Archive format marker, written as the first line of an archive object.
+const (
+	archiveFormat  = "double-team/ndjson"
+	archiveVersion = 1
+)
+
+type archiveHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// writeObject writes messages as a compressed, newline delimited archive
+// object: a format header followed by one message per line.
+func writeObject(w io.Writer, msgs Messages, c Compression) error {
+	ow, err := newObjectWriter(w, c)
+	if err != nil {
+		return err
+	}
+
+	if err := ow.Write(msgs); err != nil {
+		return err
+	}
+
+	return ow.Close()
+}
+
+// objectWriter encodes the messages of an archive object incrementally.
+type objectWriter struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func newObjectWriter(w io.Writer, c Compression) (*objectWriter, error) {
+	cw, err := compress(c, w)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := json.NewEncoder(cw)
+	if err := enc.Encode(archiveHeader{Format: archiveFormat, Version: archiveVersion}); err != nil {
+		return nil, err
+	}
+
+	return &objectWriter{w: cw, enc: enc}, nil
+}
+
+// Write encodes the messages.
+func (w *objectWriter) Write(msgs Messages) error {
+	for _, msg := range msgs {
+		if err := w.enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close flushes the object.
+func (w *objectWriter) Close() error {
+	return w.w.Close()
+}
+
+// encodeObject encodes messages as a compressed archive object.
+func encodeObject(msgs Messages, c Compression) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := writeObject(buf, msgs, c); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// objectReader decodes the messages of an archive object incrementally.
+// Both the newline delimited format and legacy JSON array objects are read.
+type objectReader struct {
+	src    io.Reader
+	r      io.ReadCloser
+	dec    *json.Decoder
+	legacy bool
+	eof    bool
+}
+
+func newObjectReader(r io.Reader, c Compression) (*objectReader, error) {
+	dr, err := decompress(c, r)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(dr)
+	first, err := peekNonSpace(br)
+	if err == io.EOF {
+		return &objectReader{src: r, r: dr, eof: true}, nil
+	}
+	if err != nil {
+		dr.Close()
+		return nil, err
+	}
+
+	or := &objectReader{src: r, r: dr, dec: json.NewDecoder(br)}
+	switch first {
+	case '[':
+		or.legacy = true
+		if _, err := or.dec.Token(); err != nil {
+			dr.Close()
+			return nil, err
+		}
+
+	case '{':
+		h := archiveHeader{}
+		if err := or.dec.Decode(&h); err != nil {
+			dr.Close()
+			return nil, err
+		}
+		if h.Format != archiveFormat || h.Version > archiveVersion {
+			dr.Close()
+			return nil, fmt.Errorf("archive: unsupported format %q version %d", h.Format, h.Version)
+		}
+
+	default:
+		dr.Close()
+		return nil, fmt.Errorf("archive: unexpected start of object %q", first)
+	}
+
+	return or, nil
+}
+
+// Next returns up to n messages, or io.EOF once all messages have been read.
+func (r *objectReader) Next(n int) (Messages, error) {
+	msgs := Messages{}
+	for len(msgs) < n && !r.eof {
+		if r.legacy && !r.dec.More() {
+			r.eof = true
+			break
+		}
+
+		msg := &Message{}
+		if err := r.dec.Decode(msg); err != nil {
+			if err == io.EOF && !r.legacy {
+				r.eof = true
+				break
+			}
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if len(msgs) == 0 && r.eof {
+		return nil, io.EOF
+	}
+	return msgs, nil
+}
+
+// Close closes the reader and the underlying reader if it is a closer.
+func (r *objectReader) Close() error {
+	err := r.r.Close()
+	if c, ok := r.src.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// decodeObject decodes all messages of a compressed archive object.
+func decodeObject(r io.Reader, c Compression) (Messages, error) {
+	or, err := newObjectReader(r, c)
+	if err != nil {
+		return nil, err
+	}
+	defer or.Close()
+
+	msgs := Messages{}
+	for {
+		batch, err := or.Next(1000)
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, batch...)
+	}
+}
+
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+
+		return b, r.UnreadByte()
+	}
+}
@@ -0,0 +1,100 @@
+package streaming
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_encodeObjectRoundTrip(t *testing.T) {
+	msgs := Messages{
+		{Topic: "test", Key: []byte("key"), Data: []byte("data")},
+		{Topic: "test", Data: []byte("more data")},
+	}
+
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionZstd, CompressionSnappy} {
+		b, err := encodeObject(msgs, c)
+		assert.NoError(t, err, string(c))
+
+		got, err := decodeObject(bytes.NewReader(b), c)
+		assert.NoError(t, err, string(c))
+		assert.Equal(t, msgs, got, string(c))
+	}
+}
+
+func Test_encodeObjectFormat(t *testing.T) {
+	b, err := encodeObject(Messages{{Topic: "a"}, {Topic: "b"}}, CompressionNone)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 3) {
+		assert.Equal(t, `{"format":"double-team/ndjson","version":1}`, lines[0])
+	}
+}
+
+func Test_decodeObjectLegacyArray(t *testing.T) {
+	msgs := Messages{{Topic: "a", Data: []byte("data")}, {Topic: "b"}}
+	b, _ := json.Marshal(msgs)
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write(b)
+	w.Close()
+
+	got, err := decodeObject(buf, CompressionGzip)
+	assert.NoError(t, err)
+	assert.Equal(t, msgs, got)
+}
+
+func Test_decodeObjectEmpty(t *testing.T) {
+	for _, s := range []string{"", "[]", "\n[ ]\n"} {
+		got, err := decodeObject(strings.NewReader(s), CompressionNone)
+		assert.NoError(t, err, s)
+		assert.Len(t, got, 0, s)
+	}
+}
+
+func Test_decodeObjectUnsupported(t *testing.T) {
+	tests := []string{
+		`{"format":"double-team/ndjson","version":2}`,
+		`{"format":"other","version":1}`,
+		`"messages"`,
+	}
+
+	for _, s := range tests {
+		_, err := decodeObject(strings.NewReader(s), CompressionNone)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestObjectReader_Next(t *testing.T) {
+	msgs := Messages{{Topic: "a"}, {Topic: "b"}, {Topic: "c"}}
+	b, _ := encodeObject(msgs, CompressionSnappy)
+
+	r, err := newObjectReader(bytes.NewReader(b), CompressionSnappy)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	got, err := r.Next(2)
+	assert.NoError(t, err)
+	assert.Equal(t, msgs[:2], got)
+
+	got, err = r.Next(2)
+	assert.NoError(t, err)
+	assert.Equal(t, msgs[2:], got)
+
+	_, err = r.Next(2)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestObjectReader_Truncated(t *testing.T) {
+	b, _ := encodeObject(Messages{{Topic: "a"}, {Topic: "b"}}, CompressionNone)
+
+	_, err := decodeObject(bytes.NewReader(b[:len(b)-5]), CompressionNone)
+	assert.Error(t, err)
+}
@@ -0,0 +1,439 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Checkpoint is the progress of a restore.
+//
+// Every object up to and including Key, in the order objects are consumed,
+// has been fully acknowledged or has failed. Done lists the objects after
+// Key that have also been acknowledged, and Failed the objects that could
+// not be restored; they are retried when the restore resumes.
+type Checkpoint struct {
+	// Listing is the index of the key range Key belongs to.
+	Listing int `json:"listing"`
+	// Prefix is the prefix of the key range Key belongs to.
+	Prefix string `json:"prefix"`
+	// Key is the last object key up to which every object is done.
+	Key string `json:"key"`
+	// Done are the keys of the objects after Key that are done.
+	Done []string `json:"done,omitempty"`
+	// Failed are the keys of the objects that failed.
+	Failed []string `json:"failed,omitempty"`
+
+	// Objects is the number of objects done.
+	Objects int64 `json:"objects"`
+	// Messages is the number of messages acknowledged in the objects done.
+	Messages int64 `json:"messages"`
+
+	Updated time.Time `json:"updated"`
+}
+
+// CheckpointStore loads and saves restore checkpoints.
+type CheckpointStore interface {
+	// Load returns the saved checkpoint, or nil if there is none.
+	Load() (*Checkpoint, error)
+	// Save saves the checkpoint.
+	Save(cp *Checkpoint) error
+}
+
+type fileCheckpointStore struct {
+	path string
+}
+
+// NewFileCheckpointStore creates a checkpoint store saving to a local file.
+func NewFileCheckpointStore(path string) CheckpointStore {
+	return &fileCheckpointStore{path: path}
+}
+
+// Load returns the saved checkpoint, or nil if there is none.
+func (s *fileCheckpointStore) Load() (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Checkpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Save saves the checkpoint.
+//
+// The checkpoint is written to a temporary file that replaces the previous
+// one, so an interrupted save keeps the previous checkpoint.
+func (s *fileCheckpointStore) Save(cp *Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+type s3CheckpointStore struct {
+	client *s3.S3
+	bucket string
+	key    string
+}
+
+// NewS3CheckpointStore creates a checkpoint store saving to an S3 marker
+// object. The marker is never restored when it is in the archive bucket.
+func NewS3CheckpointStore(endpoint, region, bucket, key string) (CheckpointStore, error) {
+	sess, err := newS3Session(endpoint, region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3CheckpointStore{
+		client: s3.New(sess),
+		bucket: bucket,
+		key:    key,
+	}, nil
+}
+
+// Load returns the saved checkpoint, or nil if there is none.
+func (s *s3CheckpointStore) Load() (*Checkpoint, error) {
+	object, err := s.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	cp := &Checkpoint{}
+	if err := json.NewDecoder(object.Body).Decode(cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Save saves the checkpoint.
+func (s *s3CheckpointStore) Save(cp *Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(&s3.PutObjectInput{
+		Body:        bytes.NewReader(b),
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// checkpointer keeps the checkpoint of a restore as objects are done,
+// saving it in the background.
+type checkpointer struct {
+	store   CheckpointStore
+	onError func(error)
+
+	mu      sync.Mutex
+	cp      Checkpoint
+	resumed *Checkpoint
+	skip    map[string]bool
+	retry   map[string]bool
+	failed  map[string]bool
+	pending []*checkpointObject
+	closed  bool
+
+	dirty   chan struct{}
+	savedWg sync.WaitGroup
+}
+
+// checkpointObject is an object being consumed. A retried object does not
+// advance the checkpoint key.
+type checkpointObject struct {
+	listing int
+	prefix  string
+	key     string
+	retry   bool
+	done    bool
+}
+
+// newCheckpointer creates a checkpointer, resuming from the saved
+// checkpoint if resume is true.
+func newCheckpointer(store CheckpointStore, resume bool, onError func(error)) (*checkpointer, error) {
+	c := &checkpointer{
+		store:   store,
+		onError: onError,
+		skip:    map[string]bool{},
+		retry:   map[string]bool{},
+		failed:  map[string]bool{},
+		dirty:   make(chan struct{}, 1),
+	}
+
+	if resume {
+		cp, err := store.Load()
+		if err != nil {
+			return nil, err
+		}
+
+		if cp != nil {
+			c.resumed = cp
+			c.cp = *cp
+			c.cp.Done = nil
+			c.cp.Failed = nil
+			for _, key := range cp.Done {
+				c.skip[key] = true
+			}
+			// failed objects are retried before the listing, which skips them
+			for _, key := range cp.Failed {
+				c.retry[key] = true
+				c.skip[key] = true
+			}
+		}
+	}
+
+	c.savedWg.Add(1)
+	go c.save()
+
+	return c, nil
+}
+
+// resume returns the key to continue the key range after, and whether the
+// key range is done.
+func (c *checkpointer) resume(listing int, prefix string) (string, bool, error) {
+	cp := c.resumed
+	if cp == nil || listing > cp.Listing {
+		return "", false, nil
+	}
+
+	if listing == cp.Listing && prefix != cp.Prefix {
+		return "", false, &checkpointError{prefix: prefix, checkpoint: cp.Prefix}
+	}
+
+	if listing < cp.Listing {
+		return "", true, nil
+	}
+	return cp.Key, false, nil
+}
+
+// retries returns the keys of the objects that failed in the resumed run,
+// in key order.
+func (c *checkpointer) retries() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return sortedKeys(c.retry)
+}
+
+// skipped reports whether the object was done in the resumed run. A
+// skipped object is recorded as done in the order objects are consumed,
+// so the checkpoint key can move past it.
+func (c *checkpointer) skipped(listing int, prefix, key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.skip[key] {
+		return false
+	}
+
+	if !c.closed {
+		delete(c.skip, key)
+		c.pending = append(c.pending, &checkpointObject{listing: listing, prefix: prefix, key: key, done: true})
+		c.advance()
+	}
+	return true
+}
+
+// start records that an object is being consumed. Objects must be started
+// in the order they are consumed.
+func (c *checkpointer) start(listing int, prefix, key string) *checkpointObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	o := &checkpointObject{listing: listing, prefix: prefix, key: key}
+	c.pending = append(c.pending, o)
+	return o
+}
+
+// startRetry records that an object that failed in the resumed run is
+// being consumed again. Retried objects must be started before the others.
+func (c *checkpointer) startRetry(key string) *checkpointObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	o := &checkpointObject{key: key, retry: true}
+	c.pending = append(c.pending, o)
+	return o
+}
+
+// done records that every message of an object has been acknowledged.
+func (c *checkpointer) done(o *checkpointObject, messages int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || o.done {
+		return
+	}
+
+	o.done = true
+	c.cp.Objects++
+	c.cp.Messages += int64(messages)
+	if o.retry {
+		delete(c.retry, o.key)
+	}
+
+	c.advance()
+}
+
+// fail records that an object could not be restored. It no longer holds
+// back the checkpoint key, and is retried when the restore resumes.
+func (c *checkpointer) fail(o *checkpointObject) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || o.done {
+		return
+	}
+
+	o.done = true
+	c.failed[o.key] = true
+	if o.retry {
+		delete(c.retry, o.key)
+	}
+
+	c.advance()
+}
+
+// advance moves the checkpoint key past the done objects at the head of
+// the pending objects, and prunes the keys of the resumed run it passed.
+func (c *checkpointer) advance() {
+	for len(c.pending) > 0 && c.pending[0].done {
+		head := c.pending[0]
+		if !head.retry {
+			c.cp.Listing = head.listing
+			c.cp.Prefix = head.prefix
+			c.cp.Key = head.key
+		}
+		c.pending = c.pending[1:]
+	}
+
+	for key := range c.skip {
+		if strings.HasPrefix(key, c.cp.Prefix) && key <= c.cp.Key {
+			delete(c.skip, key)
+		}
+	}
+
+	select {
+	case c.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// checkpoint returns the current checkpoint.
+func (c *checkpointer) checkpoint() *Checkpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp := c.cp
+	cp.Done = nil
+	for _, o := range c.pending {
+		if o.done && !o.retry && !c.failed[o.key] {
+			cp.Done = append(cp.Done, o.key)
+		}
+	}
+	// objects done in the resumed run stay done until the key passes them
+	cp.Done = append(cp.Done, sortedKeys(c.skip)...)
+
+	// failed objects, and the ones of the resumed run not retried yet
+	failed := map[string]bool{}
+	for key := range c.failed {
+		failed[key] = true
+	}
+	for key := range c.retry {
+		failed[key] = true
+	}
+	cp.Failed = sortedKeys(failed)
+	cp.Updated = time.Now().UTC()
+
+	return &cp
+}
+
+func sortedKeys(m map[string]bool) []string {
+	if len(m) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *checkpointer) save() {
+	defer c.savedWg.Done()
+
+	for range c.dirty {
+		if err := c.store.Save(c.checkpoint()); err != nil {
+			c.onError(err)
+		}
+	}
+}
+
+// Close stops recording objects and saves the final checkpoint.
+func (c *checkpointer) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.dirty)
+	c.savedWg.Wait()
+
+	return c.store.Save(c.checkpoint())
+}
+
+// checkpointError is returned when a checkpoint does not match the key
+// ranges of the restore.
+type checkpointError struct {
+	prefix     string
+	checkpoint string
+}
+
+func (e *checkpointError) Error() string {
+	return "checkpoint: key range " + e.prefix + " does not match the checkpoint key range " + e.checkpoint +
+		", resume with the options of the interrupted restore"
+}
@@ -0,0 +1,205 @@
+package streaming
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewFileCheckpointStore(filepath.Join(dir, "checkpoint.json"))
+
+	cp, err := s.Load()
+	assert.NoError(t, err)
+	assert.Nil(t, cp)
+
+	err = s.Save(&Checkpoint{Listing: 1, Prefix: "archive/", Key: "archive/a", Done: []string{"archive/c"}, Objects: 2, Messages: 10})
+	assert.NoError(t, err)
+
+	cp, err = s.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, cp.Listing)
+	assert.Equal(t, "archive/", cp.Prefix)
+	assert.Equal(t, "archive/a", cp.Key)
+	assert.Equal(t, []string{"archive/c"}, cp.Done)
+	assert.Equal(t, int64(2), cp.Objects)
+	assert.Equal(t, int64(10), cp.Messages)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestCheckpointer_AdvancesInConsumeOrder(t *testing.T) {
+	store := &memoryCheckpointStore{}
+	c, err := newCheckpointer(store, false, func(err error) { assert.NoError(t, err) })
+	assert.NoError(t, err)
+
+	a := c.start(0, "", "a")
+	b := c.start(0, "", "b")
+	c.start(0, "", "c")
+
+	c.done(b, 2)
+	cp := c.checkpoint()
+	assert.Equal(t, "", cp.Key)
+	assert.Equal(t, []string{"b"}, cp.Done)
+
+	c.done(a, 3)
+	c.done(a, 3)
+	cp = c.checkpoint()
+	assert.Equal(t, "b", cp.Key)
+	assert.Empty(t, cp.Done)
+	assert.Equal(t, int64(2), cp.Objects)
+	assert.Equal(t, int64(5), cp.Messages)
+
+	assert.NoError(t, c.Close())
+	assert.Equal(t, "b", store.cp.Key)
+
+	// objects done after close are not recorded
+	d := c.start(0, "", "d")
+	c.done(d, 1)
+	assert.Equal(t, "b", c.checkpoint().Key)
+}
+
+func TestCheckpointer_Resume(t *testing.T) {
+	store := &memoryCheckpointStore{cp: &Checkpoint{Listing: 1, Prefix: "b/", Key: "b/1", Done: []string{"b/3"}, Objects: 3, Messages: 9}}
+	c, err := newCheckpointer(store, true, func(err error) { assert.NoError(t, err) })
+	assert.NoError(t, err)
+	defer c.Close()
+
+	_, done, err := c.resume(0, "a/")
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	after, done, err := c.resume(1, "b/")
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "b/1", after)
+
+	after, done, err = c.resume(2, "c/")
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "", after)
+
+	_, _, err = c.resume(1, "other/")
+	assert.Error(t, err)
+
+	assert.False(t, c.skipped(1, "b/", "b/2"))
+	b2 := c.start(1, "b/", "b/2")
+	assert.True(t, c.skipped(1, "b/", "b/3"))
+
+	cp := c.checkpoint()
+	assert.Equal(t, "b/1", cp.Key)
+	assert.Equal(t, []string{"b/3"}, cp.Done)
+
+	c.done(b2, 1)
+	cp = c.checkpoint()
+	assert.Equal(t, "b/3", cp.Key)
+	assert.Empty(t, cp.Done)
+	assert.Equal(t, int64(4), cp.Objects)
+	assert.Equal(t, int64(10), cp.Messages)
+}
+
+func TestCheckpointer_PrunesDoneKeysTheKeyPassed(t *testing.T) {
+	store := &memoryCheckpointStore{cp: &Checkpoint{Prefix: "a/", Key: "a/1", Done: []string{"a/3"}}}
+	c, err := newCheckpointer(store, true, func(err error) { assert.NoError(t, err) })
+	assert.NoError(t, err)
+	defer c.Close()
+
+	// a/3 is gone and never listed again
+	c.done(c.start(0, "a/", "a/4"), 1)
+
+	cp := c.checkpoint()
+	assert.Equal(t, "a/4", cp.Key)
+	assert.Empty(t, cp.Done)
+}
+
+func TestCheckpointer_FailedObjectsDoNotHoldBackTheKey(t *testing.T) {
+	store := &memoryCheckpointStore{}
+	c, err := newCheckpointer(store, false, func(err error) { assert.NoError(t, err) })
+	assert.NoError(t, err)
+
+	a := c.start(0, "", "a")
+	b := c.start(0, "", "b")
+	d := c.start(0, "", "c")
+
+	c.done(d, 1)
+	c.fail(a)
+	c.done(a, 1)
+	cp := c.checkpoint()
+	assert.Equal(t, "a", cp.Key)
+	assert.Equal(t, []string{"c"}, cp.Done)
+	assert.Equal(t, []string{"a"}, cp.Failed)
+
+	c.done(b, 1)
+	cp = c.checkpoint()
+	assert.Equal(t, "c", cp.Key)
+	assert.Empty(t, cp.Done)
+	assert.Equal(t, []string{"a"}, cp.Failed)
+	assert.Equal(t, int64(2), cp.Objects)
+
+	assert.NoError(t, c.Close())
+}
+
+func TestCheckpointer_ResumeRetriesFailedObjects(t *testing.T) {
+	store := &memoryCheckpointStore{cp: &Checkpoint{Key: "b", Done: []string{"d"}, Failed: []string{"a", "c"}}}
+	c, err := newCheckpointer(store, true, func(err error) { assert.NoError(t, err) })
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"a", "c"}, c.retries())
+
+	a := c.startRetry("a")
+	retried := c.startRetry("c")
+
+	// the listing skips the retried objects
+	assert.True(t, c.skipped(0, "", "c"))
+	assert.True(t, c.skipped(0, "", "d"))
+
+	cp := c.checkpoint()
+	assert.Equal(t, "b", cp.Key)
+	assert.Equal(t, []string{"a", "c"}, cp.Failed)
+
+	c.done(a, 1)
+	c.fail(retried)
+	cp = c.checkpoint()
+	assert.Equal(t, "d", cp.Key)
+	assert.Empty(t, cp.Done)
+	assert.Equal(t, []string{"c"}, cp.Failed)
+
+	assert.NoError(t, c.Close())
+	assert.Equal(t, []string{"c"}, store.cp.Failed)
+}
+
+func TestCheckpointer_WithoutResumeStartsOver(t *testing.T) {
+	store := &memoryCheckpointStore{cp: &Checkpoint{Key: "b", Objects: 3}}
+	c, err := newCheckpointer(store, false, func(err error) { assert.NoError(t, err) })
+	assert.NoError(t, err)
+
+	after, done, err := c.resume(0, "")
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "", after)
+
+	assert.NoError(t, c.Close())
+	assert.Equal(t, int64(0), store.cp.Objects)
+}
+
+type memoryCheckpointStore struct {
+	cp *Checkpoint
+}
+
+func (s *memoryCheckpointStore) Load() (*Checkpoint, error) {
+	return s.cp, nil
+}
+
+func (s *memoryCheckpointStore) Save(cp *Checkpoint) error {
+	s.cp = cp
+	return nil
+}
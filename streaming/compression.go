@@ -0,0 +1,107 @@
+package streaming
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the codec used to compress archive objects.
+type Compression string
+
+// Archive compression codecs.
+const (
+	CompressionNone   Compression = "none"
+	CompressionGzip   Compression = "gzip"
+	CompressionZstd   Compression = "zstd"
+	CompressionSnappy Compression = "snappy"
+)
+
+var compressionExts = map[Compression]string{
+	CompressionNone:   "",
+	CompressionGzip:   ".gz",
+	CompressionZstd:   ".zst",
+	CompressionSnappy: ".sz",
+}
+
+// Validate checks the compression is a known codec.
+func (c Compression) Validate() error {
+	if _, ok := compressionExts[c]; !ok {
+		return fmt.Errorf("compression: unknown codec %q", c)
+	}
+	return nil
+}
+
+// Ext returns the key extension of the codec.
+func (c Compression) Ext() string {
+	return compressionExts[c]
+}
+
+// compressionFromKey detects the codec from the key extension.
+func compressionFromKey(key string) (Compression, bool) {
+	for c, ext := range compressionExts {
+		if ext != "" && strings.HasSuffix(key, ext) {
+			return c, true
+		}
+	}
+	return CompressionNone, false
+}
+
+// compress wraps the writer with the codec. Closing the returned writer
+// flushes the codec but does not close w.
+func compress(c Compression, w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	default:
+		return nil, c.Validate()
+	}
+}
+
+// decompress wraps the reader with the codec.
+func decompress(c Compression, r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return ioutil.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	case CompressionSnappy:
+		return ioutil.NopCloser(snappy.NewReader(r)), nil
+	default:
+		return nil, c.Validate()
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
@@ -0,0 +1,77 @@
+package streaming
+
+import (
+	"path"
+	"time"
+)
+
+// Filter selects the messages a Consumer outputs.
+//
+// Time bounds apply to archive objects as a whole, topic patterns to the
+// individual messages. Patterns use path.Match syntax, e.g. "orders.*".
+type Filter struct {
+	// From is the inclusive start time. Unbounded if zero.
+	From time.Time
+	// To is the exclusive end time. Unbounded if zero.
+	To time.Time
+	// Include lists the topic patterns to output. All topics if empty.
+	Include []string
+	// Exclude lists the topic patterns not to output.
+	Exclude []string
+}
+
+// Validate checks the topic patterns of the filter.
+func (f Filter) Validate() error {
+	for _, pattern := range append(f.Include, f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Before reports whether t is before the start of the filter.
+func (f Filter) Before(t time.Time) bool {
+	return !f.From.IsZero() && t.Before(f.From)
+}
+
+// After reports whether t is at or after the end of the filter.
+func (f Filter) After(t time.Time) bool {
+	return !f.To.IsZero() && !t.Before(f.To)
+}
+
+// MatchTopic reports whether messages of the topic pass the filter.
+func (f Filter) MatchTopic(topic string) bool {
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return false
+		}
+	}
+
+	if len(f.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, topic); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Split splits messages into those passing the filter and the rest.
+func (f Filter) Split(msgs Messages) (Messages, Messages) {
+	var matched, rest Messages
+	for _, msg := range msgs {
+		if f.MatchTopic(msg.Topic) {
+			matched = append(matched, msg)
+			continue
+		}
+		rest = append(rest, msg)
+	}
+
+	return matched, rest
+}
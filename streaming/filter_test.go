@@ -0,0 +1,57 @@
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter_Times(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+	f := Filter{From: from, To: to}
+
+	assert.True(t, f.Before(from.Add(-time.Second)))
+	assert.False(t, f.Before(from))
+	assert.False(t, f.After(to.Add(-time.Second)))
+	assert.True(t, f.After(to))
+
+	f = Filter{}
+	assert.False(t, f.Before(from))
+	assert.False(t, f.After(to))
+}
+
+func TestFilter_MatchTopic(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		topic  string
+		want   bool
+	}{
+		{Filter{}, "orders", true},
+		{Filter{Include: []string{"orders*"}}, "orders.eu", true},
+		{Filter{Include: []string{"orders*"}}, "payments", false},
+		{Filter{Exclude: []string{"orders.*"}}, "orders.eu", false},
+		{Filter{Exclude: []string{"orders.*"}}, "orders", true},
+		{Filter{Include: []string{"orders*"}, Exclude: []string{"orders.test"}}, "orders.test", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.filter.MatchTopic(tt.topic), tt.topic)
+	}
+}
+
+func TestFilter_Split(t *testing.T) {
+	f := Filter{Include: []string{"orders"}}
+	msgs := Messages{{Topic: "orders"}, {Topic: "payments"}, {Topic: "orders"}}
+
+	matched, rest := f.Split(msgs)
+
+	assert.Len(t, matched, 2)
+	assert.Equal(t, Messages{{Topic: "payments"}}, rest)
+}
+
+func TestFilter_Validate(t *testing.T) {
+	assert.NoError(t, Filter{Include: []string{"orders*"}}.Validate())
+	assert.Error(t, Filter{Exclude: []string{"orders["}}.Validate())
+}
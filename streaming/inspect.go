@@ -0,0 +1,102 @@
+package streaming
+
+import (
+	"io"
+	"time"
+)
+
+// ObjectInfo describes an archive object.
+type ObjectInfo struct {
+	Key  string
+	Time time.Time
+	// Size is the stored size of the object in bytes.
+	Size int64
+	// Messages is the number of messages in the object.
+	Messages int
+	// Matched is the number of messages in the object passing the filter.
+	Matched int
+	// Err is the error the object could not be read with, if any. The
+	// counts are those of the messages read before the error.
+	Err error
+}
+
+// S3Inspector reads archive objects from AWS S3 without changing them.
+type S3Inspector struct {
+	c *s3Consumer
+}
+
+// NewS3Inspector creates an inspector of the archive bucket. The consumer
+// options set the restored objects and checkpoint marker to skip, like a
+// restore does; the inspector is always read only.
+func NewS3Inspector(endpoint, region, bucket string, layout *KeyLayout, opts ...S3ConsumerOptFunc) (*S3Inspector, error) {
+	opts = append(append([]S3ConsumerOptFunc{}, opts...), WithS3ReadOnly())
+	c, err := NewS3Consumer(endpoint, region, bucket, layout, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Inspector{c: c.(*s3Consumer)}, nil
+}
+
+// Inspect reads the archive objects passing the filter, in the order they
+// are restored. Objects already restored are skipped. Each message passing
+// the filter is passed to msgFn, and each object to objFn once it has been
+// read, with the error it could not be read with, if any. Inspect stops at
+// the first listing error or error returned by the functions.
+func (i *S3Inspector) Inspect(f Filter, objFn func(ObjectInfo) error, msgFn func(*Message) error) error {
+	var inspectErr error
+	err := i.c.walk(f, func(obj archiveObject) bool {
+		inspectErr = i.inspect(obj, f, objFn, msgFn)
+		return inspectErr == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return inspectErr
+}
+
+func (i *S3Inspector) inspect(obj archiveObject, f Filter, objFn func(ObjectInfo) error, msgFn func(*Message) error) error {
+	info := ObjectInfo{Key: obj.key, Time: obj.time, Size: obj.size}
+
+	_, tagged, err := restoredAt(i.c.client, i.c.bucket, obj.key)
+	if err != nil {
+		info.Err = err
+		return objFn(info)
+	}
+	if tagged {
+		return nil
+	}
+
+	r, _, err := i.c.open(obj.key)
+	if err != nil {
+		info.Err = err
+		return objFn(info)
+	}
+	defer r.Close()
+
+	for {
+		msgs, err := r.Next(consumeChunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			info.Err = err
+			break
+		}
+		info.Messages += len(msgs)
+
+		for _, msg := range msgs {
+			if !f.MatchTopic(msg.Topic) {
+				continue
+			}
+			info.Matched++
+
+			if err := msgFn(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return objFn(info)
+}
@@ -0,0 +1,86 @@
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3Inspector_Inspect(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(3)
+	s.put(t, "archive", keys[0], Messages{{Topic: "orders"}, {Topic: "payments"}})
+	s.putRaw("archive", keys[1], []byte("{not json\n"))
+	s.put(t, "archive", keys[2], Messages{{Topic: "orders"}})
+	s.put(t, "archive", "restored/run/"+keys[0], Messages{{Topic: "orders"}})
+	s.putRaw("archive", "checkpoint.json", []byte(`{"run":"run"}`))
+
+	store, err := NewS3CheckpointStore(s.URL, "eu-west-1", "archive", "checkpoint.json")
+	assert.NoError(t, err)
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	i, err := NewS3Inspector(s.URL, "eu-west-1", "archive", l,
+		WithS3Restored(Restored{Mode: RestoredMove, Prefix: "restored/"}),
+		WithS3Checkpoint(store, false),
+	)
+	assert.NoError(t, err)
+
+	var objects []ObjectInfo
+	var topics []string
+	err = i.Inspect(Filter{Include: []string{"orders"}}, func(obj ObjectInfo) error {
+		objects = append(objects, obj)
+		return nil
+	}, func(msg *Message) error {
+		topics = append(topics, msg.Topic)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"orders", "orders"}, topics)
+	if assert.Len(t, objects, 3) {
+		assert.Equal(t, keys[0], objects[0].Key)
+		assert.Equal(t, 2, objects[0].Messages)
+		assert.Equal(t, 1, objects[0].Matched)
+		assert.NoError(t, objects[0].Err)
+
+		assert.Equal(t, keys[1], objects[1].Key)
+		assert.Error(t, objects[1].Err)
+
+		assert.Equal(t, keys[2], objects[2].Key)
+		assert.NoError(t, objects[2].Err)
+	}
+
+	// the inspector leaves the bucket and the checkpoint untouched
+	assert.Equal(t, []string{keys[0], keys[1], keys[2], "checkpoint.json", "restored/run/" + keys[0]}, s.keys("archive"))
+	marker, _ := s.object("archive", "checkpoint.json")
+	assert.Equal(t, []byte(`{"run":"run"}`), marker.data)
+}
+
+func TestS3Inspector_InspectSkipsTaggedObjects(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(2)
+	s.put(t, "archive", keys[0], Messages{{Topic: "orders"}})
+	s.put(t, "archive", keys[1], Messages{{Topic: "orders"}})
+	tagged, _ := s.object("archive", keys[0])
+	tagged.tags = map[string]string{"restored-at": time.Now().UTC().Format(time.RFC3339)}
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	i, err := NewS3Inspector(s.URL, "eu-west-1", "archive", l, WithS3Restored(Restored{Mode: RestoredTag}))
+	assert.NoError(t, err)
+
+	var objects []string
+	err = i.Inspect(Filter{}, func(obj ObjectInfo) error {
+		objects = append(objects, obj.Key)
+		return nil
+	}, func(msg *Message) error {
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{keys[1]}, objects)
+}
@@ -1,6 +1,11 @@
 package streaming
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"sync"
 	"time"
 
@@ -9,29 +14,343 @@ import (
 )
 
 type kafkaProducer struct {
+	name     string
 	client   sarama.Client
 	producer sarama.AsyncProducer
 
 	breaker *breaker.Breaker
-	input   chan *Message
-	errors  chan *Error
-	wg      sync.WaitGroup
+	// calls are the breaker calls of the messages in flight
+	calls  sync.Map
+	input  chan *Message
+	errors chan *Error
+	wg     sync.WaitGroup
 }
 
-// NewKafkaProducer creates a new producer that sends messages to Kafka.
-func NewKafkaProducer(brokers []string, version string, retry int) (Producer, error) {
+// Kafka producer defaults.
+const (
+	DefaultKafkaName            = "kafka"
+	DefaultKafkaRetry           = 5
+	DefaultKafkaAcks            = "local"
+	DefaultKafkaCompression     = "snappy"
+	DefaultKafkaFlushFrequency  = 500 * time.Millisecond
+	DefaultKafkaMaxMessageBytes = 1000000
+	DefaultKafkaRetryBackoff    = 10 * time.Millisecond
+	DefaultKafkaPartitioner     = "hash"
+)
+
+var kafkaAcks = map[string]sarama.RequiredAcks{
+	"none":  sarama.NoResponse,
+	"local": sarama.WaitForLocal,
+	"all":   sarama.WaitForAll,
+}
+
+var kafkaCompressions = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+var kafkaPartitioners = map[string]sarama.PartitionerConstructor{
+	"hash":        sarama.NewHashPartitioner,
+	"random":      sarama.NewRandomPartitioner,
+	"round-robin": sarama.NewRoundRobinPartitioner,
+	"murmur2":     sarama.NewCustomPartitioner(sarama.WithAbsFirst(), sarama.WithCustomHashFunction(newMurmur2)),
+}
+
+type kafkaOptions struct {
+	name            string
+	acks            string
+	compression     string
+	flushBytes      int
+	flushMessages   int
+	flushFrequency  time.Duration
+	maxMessageBytes int
+	retryBackoff    time.Duration
+	partitioner     string
+	clientID        string
+	idempotent      bool
+
+	tls         bool
+	tlsCAFile   string
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsInsecure bool
+
+	saslMechanism string
+	saslUser      string
+	saslPassword  string
+}
+
+// KafkaOptFunc represents a configuration function for the Kafka producer.
+type KafkaOptFunc func(o *kafkaOptions)
+
+// WithKafkaName sets the name of the producer, which tells producers of
+// different clusters apart in logs, metrics and acknowledgements.
+func WithKafkaName(name string) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.name = name
+	})
+}
+
+// WithKafkaAcks sets the acknowledgements required from the brokers
+// (options: none, local, all).
+func WithKafkaAcks(acks string) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.acks = acks
+	})
+}
+
+// WithKafkaCompression sets the codec message batches are compressed with
+// (options: none, gzip, snappy, lz4, zstd).
+func WithKafkaCompression(codec string) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.compression = codec
+	})
+}
+
+// WithKafkaFlushBytes sets the number of bytes that triggers a flush.
+func WithKafkaFlushBytes(n int) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.flushBytes = n
+	})
+}
+
+// WithKafkaFlushMessages sets the number of messages that triggers a flush.
+func WithKafkaFlushMessages(n int) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.flushMessages = n
+	})
+}
+
+// WithKafkaFlushFrequency sets the interval messages are flushed at.
+func WithKafkaFlushFrequency(d time.Duration) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.flushFrequency = d
+	})
+}
+
+// WithKafkaMaxMessageBytes sets the maximum size of a message.
+func WithKafkaMaxMessageBytes(n int) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.maxMessageBytes = n
+	})
+}
+
+// WithKafkaRetryBackoff sets the time to wait before retrying to produce.
+func WithKafkaRetryBackoff(d time.Duration) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.retryBackoff = d
+	})
+}
+
+// WithKafkaPartitioner sets the partitioner of messages without an explicit
+// partition (options: hash, random, round-robin, murmur2).
+func WithKafkaPartitioner(name string) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.partitioner = name
+	})
+}
+
+// WithKafkaClientID sets the client ID sent to the brokers.
+func WithKafkaClientID(id string) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.clientID = id
+	})
+}
+
+// WithKafkaIdempotent enables the idempotent producer, so that retries do
+// not duplicate messages. It requires acks from all in-sync replicas, and
+// limits the producer to a single in-flight request per broker.
+func WithKafkaIdempotent(idempotent bool) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.idempotent = idempotent
+	})
+}
+
+// WithKafkaTLS enables TLS connections to the brokers. The CA file replaces
+// the system root certificates, and the client certificate and key are used
+// for mutual TLS. Empty files are not used.
+func WithKafkaTLS(caFile, certFile, keyFile string, insecure bool) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.tls = true
+		o.tlsCAFile = caFile
+		o.tlsCertFile = certFile
+		o.tlsKeyFile = keyFile
+		o.tlsInsecure = insecure
+	})
+}
+
+// WithKafkaSASL enables SASL authentication with the brokers
+// (mechanisms: plain, scram-sha-256, scram-sha-512).
+func WithKafkaSASL(mechanism, user, password string) KafkaOptFunc {
+	return KafkaOptFunc(func(o *kafkaOptions) {
+		o.saslMechanism = mechanism
+		o.saslUser = user
+		o.saslPassword = password
+	})
+}
+
+func newKafkaOptions(opts ...KafkaOptFunc) *kafkaOptions {
+	o := &kafkaOptions{
+		name:            DefaultKafkaName,
+		acks:            DefaultKafkaAcks,
+		compression:     DefaultKafkaCompression,
+		flushFrequency:  DefaultKafkaFlushFrequency,
+		maxMessageBytes: DefaultKafkaMaxMessageBytes,
+		retryBackoff:    DefaultKafkaRetryBackoff,
+		partitioner:     DefaultKafkaPartitioner,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// config creates the sarama configuration from the options.
+func (o *kafkaOptions) config(version string, retry int) (*sarama.Config, error) {
+	if o.name == "" {
+		return nil, errors.New("kafka: the producer name must not be empty")
+	}
+
 	ver, err := sarama.ParseKafkaVersion(version)
 	if err != nil {
 		return nil, err
 	}
+
+	acks, ok := kafkaAcks[o.acks]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown acks %q", o.acks)
+	}
+	compression, ok := kafkaCompressions[o.compression]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown compression codec %q", o.compression)
+	}
+	partitioner, ok := kafkaPartitioners[o.partitioner]
+	if !ok {
+		return nil, fmt.Errorf("kafka: unknown partitioner %q", o.partitioner)
+	}
+
 	config := sarama.NewConfig()
 	config.Version = ver
+	if o.clientID != "" {
+		config.ClientID = o.clientID
+	}
 	config.Metadata.RefreshFrequency = 30 * time.Second
-	config.Producer.RequiredAcks = sarama.WaitForLocal
-	config.Producer.Compression = sarama.CompressionSnappy
-	config.Producer.Flush.Frequency = 500 * time.Millisecond
+	config.Producer.RequiredAcks = acks
+	config.Producer.Compression = compression
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = newExplicitPartitioner(partitioner)
+	config.Producer.Flush.Bytes = o.flushBytes
+	config.Producer.Flush.Messages = o.flushMessages
+	config.Producer.Flush.Frequency = o.flushFrequency
+	config.Producer.MaxMessageBytes = o.maxMessageBytes
 	config.Producer.Retry.Max = retry
-	config.Producer.Retry.Backoff = 10 * time.Millisecond
+	config.Producer.Retry.Backoff = o.retryBackoff
+
+	if o.idempotent {
+		if acks != sarama.WaitForAll {
+			return nil, errors.New("kafka: the idempotent producer requires acks from all replicas")
+		}
+		if retry < 1 {
+			return nil, errors.New("kafka: the idempotent producer requires at least one retry")
+		}
+
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+
+	if o.tls {
+		tlsConfig, err := newTLSConfig(o)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if err := configureSASL(config, o); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("kafka: %v", err)
+	}
+
+	return config, nil
+}
+
+// newTLSConfig creates the TLS configuration from the options.
+func newTLSConfig(o *kafkaOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: o.tlsInsecure}
+
+	if o.tlsCAFile != "" {
+		ca, err := ioutil.ReadFile(o.tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: reading TLS CA file: %v", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("kafka: no PEM certificates found in TLS CA file %q", o.tlsCAFile)
+		}
+	}
+
+	if (o.tlsCertFile == "") != (o.tlsKeyFile == "") {
+		return nil, errors.New("kafka: TLS client certificate and key must be set together")
+	}
+	if o.tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.tlsCertFile, o.tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka: loading TLS client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// configureSASL configures the SASL authentication from the options.
+func configureSASL(config *sarama.Config, o *kafkaOptions) error {
+	switch o.saslMechanism {
+	case "":
+		return nil
+	case "plain":
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case "scram-sha-256":
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClient(scramSHA256)
+	case "scram-sha-512":
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClient(scramSHA512)
+	default:
+		return fmt.Errorf("kafka: unknown SASL mechanism %q", o.saslMechanism)
+	}
+
+	if o.saslUser == "" || o.saslPassword == "" {
+		return errors.New("kafka: SASL user and password must be set")
+	}
+
+	config.Net.SASL.Enable = true
+	if config.Version.IsAtLeast(sarama.V1_0_0_0) {
+		config.Net.SASL.Version = sarama.SASLHandshakeV1
+	}
+	config.Net.SASL.User = o.saslUser
+	config.Net.SASL.Password = o.saslPassword
+
+	return nil
+}
+
+// NewKafkaProducer creates a new producer that sends messages to Kafka.
+func NewKafkaProducer(brokers []string, version string, retry int, opts ...KafkaOptFunc) (Producer, error) {
+	o := newKafkaOptions(opts...)
+	config, err := o.config(version, retry)
+	if err != nil {
+		return nil, err
+	}
 
 	client, err := sarama.NewClient(brokers, config)
 	if err != nil {
@@ -44,14 +363,17 @@ func NewKafkaProducer(brokers []string, version string, retry int) (Producer, er
 	}
 
 	p := &kafkaProducer{
+		name:     o.name,
 		client:   client,
 		producer: producer,
-		breaker:  breaker.New(5, 1*time.Second),
+		breaker:  breaker.New(5, 1*time.Second, breaker.WithTrialCalls(10)),
 		input:    make(chan *Message),
 		errors:   make(chan *Error, 100),
 	}
 
+	p.wg.Add(2)
 	go p.dispatchMessages()
+	go p.dispatchSuccesses()
 	go p.dispatchErrors()
 
 	return p, nil
@@ -59,7 +381,7 @@ func NewKafkaProducer(brokers []string, version string, retry int) (Producer, er
 
 // Name is the name of the producer.
 func (p *kafkaProducer) Name() string {
-	return "kafka"
+	return p.name
 }
 
 // Input is the message input channel.
@@ -97,50 +419,117 @@ func (p *kafkaProducer) IsHealthy() bool {
 	return false
 }
 
+// BreakerState returns the state of the circuit-breaker guarding the producer.
+func (p *kafkaProducer) BreakerState() breaker.State {
+	return p.breaker.State()
+}
+
 func (p *kafkaProducer) dispatchMessages() {
 	for msg := range p.input {
-		err := p.breaker.Run(func() {
-			p.producer.Input() <- newProducerMessage(msg)
-		})
-
+		call, err := p.breaker.Allow()
 		if err != nil {
 			p.errors <- &Error{
 				Msgs: Messages{msg},
 				Err:  err,
 			}
+			continue
 		}
+
+		p.calls.Store(msg, call)
+		p.producer.Input() <- newProducerMessage(msg)
+	}
+}
+
+// report reports the outcome of a message to the breaker.
+func (p *kafkaProducer) report(msg *Message, success bool) {
+	call, ok := p.calls.Load(msg)
+	if !ok {
+		return
+	}
+	p.calls.Delete(msg)
+
+	if success {
+		call.(*breaker.Call).Success()
+		return
+	}
+	call.(*breaker.Call).Error()
+}
+
+func (p *kafkaProducer) dispatchSuccesses() {
+	defer p.wg.Done()
+
+	for msg := range p.producer.Successes() {
+		m := msg.Metadata.(*Message)
+		p.report(m, true)
+		m.Acknowledge(p.Name())
 	}
 }
 
 func (p *kafkaProducer) dispatchErrors() {
-	p.wg.Add(1)
+	defer p.wg.Done()
 
 	for err := range p.producer.Errors() {
-		p.breaker.Error()
+		p.report(err.Msg.Metadata.(*Message), false)
 		p.errors <- &Error{
-			Msgs: Messages{
-				{
-					Topic: err.Msg.Topic,
-					Key:   err.Msg.Key.(sarama.ByteEncoder),
-					Data:  err.Msg.Value.(sarama.ByteEncoder),
-				},
-			},
-			Err: err.Err,
+			Msgs: Messages{err.Msg.Metadata.(*Message)},
+			Err:  err.Err,
 		}
 	}
-
-	p.wg.Done()
 }
 
 func newProducerMessage(msg *Message) *sarama.ProducerMessage {
 	m := &sarama.ProducerMessage{
-		Topic: msg.Topic,
-		Value: sarama.ByteEncoder(msg.Data),
+		Topic:    msg.Topic,
+		Value:    sarama.ByteEncoder(msg.Data),
+		Metadata: msg,
 	}
 
 	if len(msg.Key) > 0 {
 		m.Key = sarama.ByteEncoder(msg.Key)
 	}
 
+	for _, h := range msg.Headers {
+		m.Headers = append(m.Headers, sarama.RecordHeader{Key: []byte(h.Key), Value: h.Value})
+	}
+
+	if msg.Partition != nil {
+		m.Partition = *msg.Partition
+	}
+
+	if !msg.Timestamp.IsZero() {
+		m.Timestamp = msg.Timestamp
+	}
+
 	return m
 }
+
+// explicitPartitioner sends messages with an explicit partition to that
+// partition, and all other messages through the fallback partitioner.
+type explicitPartitioner struct {
+	fallback sarama.Partitioner
+}
+
+func newExplicitPartitioner(fallback sarama.PartitionerConstructor) sarama.PartitionerConstructor {
+	return func(topic string) sarama.Partitioner {
+		return &explicitPartitioner{fallback: fallback(topic)}
+	}
+}
+
+// Partition takes a message and partition count and chooses a partition.
+func (p *explicitPartitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if m, ok := msg.Metadata.(*Message); ok && m.Partition != nil {
+		if *m.Partition < 0 || *m.Partition >= numPartitions {
+			return -1, sarama.ErrInvalidPartition
+		}
+		return *m.Partition, nil
+	}
+
+	return p.fallback.Partition(msg, numPartitions)
+}
+
+// RequiresConsistency indicates to the user of the partitioner whether the
+// mapping of key->partition is consistent or not. Explicit partitions must
+// always be respected.
+func (p *explicitPartitioner) RequiresConsistency() bool {
+	return true
+}
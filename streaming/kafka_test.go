@@ -1,7 +1,19 @@
 package streaming
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 	"github.com/magiconair/properties/assert"
 	"github.com/Shopify/sarama"
 )
@@ -18,6 +30,7 @@ func Test_newProducerMessage(t *testing.T) {
 	assert.Equal(t, pm.Topic, "topic")
 	assert.Equal(t, pm.Key, sarama.ByteEncoder("key"))
 	assert.Equal(t, pm.Value, sarama.ByteEncoder("data"))
+	assert.Equal(t, pm.Metadata, m)
 }
 
 func Test_newProducerMessageWithEmptyKey(t *testing.T) {
@@ -33,3 +46,218 @@ func Test_newProducerMessageWithEmptyKey(t *testing.T) {
 	assert.Equal(t, pm.Key, nil)
 	assert.Equal(t, pm.Value, sarama.ByteEncoder("data"))
 }
+
+func Test_newProducerMessageWithHeadersPartitionAndTimestamp(t *testing.T) {
+	partition := int32(3)
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := &Message{
+		Topic:     "topic",
+		Data:      []byte("data"),
+		Headers:   []Header{{Key: "route", Value: []byte("eu")}},
+		Partition: &partition,
+		Timestamp: ts,
+	}
+
+	pm := newProducerMessage(m)
+
+	assert.Equal(t, pm.Headers, []sarama.RecordHeader{{Key: []byte("route"), Value: []byte("eu")}})
+	assert.Equal(t, pm.Partition, int32(3))
+	assert.Equal(t, pm.Timestamp, ts)
+}
+
+func Test_explicitPartitioner(t *testing.T) {
+	p := newExplicitPartitioner(sarama.NewManualPartitioner)("topic")
+
+	partition := int32(3)
+	pm := newProducerMessage(&Message{Topic: "topic", Partition: &partition})
+	got, err := p.Partition(pm, 4)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, got, int32(3))
+
+	_, err = p.Partition(pm, 2)
+	assert.Equal(t, err, sarama.ErrInvalidPartition)
+
+	pm = newProducerMessage(&Message{Topic: "topic"})
+	got, err = p.Partition(pm, 4)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, got, int32(0))
+}
+
+func TestKafkaOptions_config(t *testing.T) {
+	config, err := newKafkaOptions(
+		WithKafkaAcks("all"),
+		WithKafkaCompression("lz4"),
+		WithKafkaFlushBytes(1024),
+		WithKafkaFlushMessages(100),
+		WithKafkaFlushFrequency(time.Second),
+		WithKafkaMaxMessageBytes(2048),
+		WithKafkaRetryBackoff(time.Second),
+		WithKafkaPartitioner("murmur2"),
+		WithKafkaClientID("double-team"),
+	).config("2.3.0", 3)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config.Producer.RequiredAcks, sarama.WaitForAll)
+	assert.Equal(t, config.Producer.Compression, sarama.CompressionLZ4)
+	assert.Equal(t, config.Producer.Flush.Bytes, 1024)
+	assert.Equal(t, config.Producer.Flush.Messages, 100)
+	assert.Equal(t, config.Producer.Flush.Frequency, time.Second)
+	assert.Equal(t, config.Producer.MaxMessageBytes, 2048)
+	assert.Equal(t, config.Producer.Retry.Max, 3)
+	assert.Equal(t, config.Producer.Retry.Backoff, time.Second)
+	assert.Equal(t, config.ClientID, "double-team")
+}
+
+func TestKafkaOptions_configDefaults(t *testing.T) {
+	config, err := newKafkaOptions().config("2.3.0", 5)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config.Producer.RequiredAcks, sarama.WaitForLocal)
+	assert.Equal(t, config.Producer.Compression, sarama.CompressionSnappy)
+	assert.Equal(t, config.Producer.Flush.Frequency, 500*time.Millisecond)
+	assert.Equal(t, config.Producer.Retry.Backoff, 10*time.Millisecond)
+	assert.Equal(t, config.ClientID, "sarama")
+}
+
+func TestKafkaOptions_configInvalid(t *testing.T) {
+	tests := []KafkaOptFunc{
+		WithKafkaAcks("some"),
+		WithKafkaCompression("brotli"),
+		WithKafkaPartitioner("sticky"),
+		WithKafkaMaxMessageBytes(0),
+	}
+
+	for _, opt := range tests {
+		_, err := newKafkaOptions(opt).config("2.3.0", 5)
+		assert.Equal(t, err != nil, true)
+	}
+}
+
+func Test_murmur2Partitioner(t *testing.T) {
+	p := newExplicitPartitioner(kafkaPartitioners["murmur2"])("topic")
+
+	pm := newProducerMessage(&Message{Topic: "topic", Key: []byte("foobar")})
+	got, err := p.Partition(pm, 10)
+
+	// (-790332482 & 0x7fffffff) % 10
+	assert.Equal(t, err, nil)
+	assert.Equal(t, got, int32(6))
+}
+
+func TestKafkaOptions_configTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	config, err := newKafkaOptions(WithKafkaTLS(certFile, certFile, keyFile, false)).config("2.3.0", 5)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config.Net.TLS.Enable, true)
+	assert.Equal(t, len(config.Net.TLS.Config.Certificates), 1)
+	assert.Equal(t, config.Net.TLS.Config.RootCAs != nil, true)
+}
+
+func TestKafkaOptions_configInvalidTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Equal(t, err, nil)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCertificate(t, dir)
+	notPEM := filepath.Join(dir, "ca.txt")
+	ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+
+	tests := []KafkaOptFunc{
+		WithKafkaTLS(filepath.Join(dir, "missing.pem"), "", "", false),
+		WithKafkaTLS(notPEM, "", "", false),
+		WithKafkaTLS("", certFile, "", false),
+		WithKafkaTLS("", certFile, certFile, false),
+		WithKafkaTLS("", keyFile, keyFile, false),
+	}
+
+	for _, opt := range tests {
+		_, err := newKafkaOptions(opt).config("2.3.0", 5)
+		assert.Equal(t, err != nil, true)
+	}
+}
+
+func TestKafkaOptions_configSASL(t *testing.T) {
+	config, err := newKafkaOptions(WithKafkaSASL("scram-sha-512", "user", "pass")).config("2.3.0", 5)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config.Net.SASL.Enable, true)
+	assert.Equal(t, config.Net.SASL.Mechanism, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512))
+	assert.Equal(t, config.Net.SASL.Version, sarama.SASLHandshakeV1)
+	assert.Equal(t, config.Net.SASL.SCRAMClientGeneratorFunc != nil, true)
+
+	client := config.Net.SASL.SCRAMClientGeneratorFunc()
+	assert.Equal(t, client.Begin("user", "pass", ""), nil)
+	first, err := client.Step("")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, strings.HasPrefix(first, "n,,n=user,r="), true)
+}
+
+func TestKafkaOptions_configInvalidSASL(t *testing.T) {
+	tests := []KafkaOptFunc{
+		WithKafkaSASL("gssapi", "user", "pass"),
+		WithKafkaSASL("plain", "", "pass"),
+		WithKafkaSASL("scram-sha-256", "user", ""),
+	}
+
+	for _, opt := range tests {
+		_, err := newKafkaOptions(opt).config("2.3.0", 5)
+		assert.Equal(t, err != nil, true)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate and its key as PEM files.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, err, nil)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "double-team"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Equal(t, err, nil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, err, nil)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestKafkaOptions_configIdempotent(t *testing.T) {
+	config, err := newKafkaOptions(WithKafkaAcks("all"), WithKafkaIdempotent(true)).config("2.3.0", 5)
+
+	assert.Equal(t, err, nil)
+	assert.Equal(t, config.Producer.Idempotent, true)
+	assert.Equal(t, config.Net.MaxOpenRequests, 1)
+
+	_, err = newKafkaOptions(WithKafkaIdempotent(true)).config("2.3.0", 5)
+	assert.Equal(t, err != nil, true)
+
+	_, err = newKafkaOptions(WithKafkaAcks("all"), WithKafkaIdempotent(true)).config("2.3.0", 0)
+	assert.Equal(t, err != nil, true)
+
+	_, err = newKafkaOptions(WithKafkaAcks("all"), WithKafkaIdempotent(true)).config("0.10.2.0", 5)
+	assert.Equal(t, err != nil, true)
+}
+
+func TestKafkaOptions_name(t *testing.T) {
+	assert.Equal(t, newKafkaOptions().name, DefaultKafkaName)
+	assert.Equal(t, newKafkaOptions(WithKafkaName("kafka-dr")).name, "kafka-dr")
+
+	_, err := newKafkaOptions(WithKafkaName("")).config("2.3.0", 5)
+	assert.Equal(t, err != nil, true)
+}
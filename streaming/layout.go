@@ -0,0 +1,303 @@
+package streaming
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// DefaultKeyLayout is the flat key layout of archive objects.
+const DefaultKeyLayout = "{ksuid}"
+
+// Key layout placeholders.
+const (
+	placeholderTopic = "{topic}"
+	placeholderYear  = "{yyyy}"
+	placeholderMonth = "{mm}"
+	placeholderDay   = "{dd}"
+	placeholderHour  = "{hh}"
+	placeholderKSUID = "{ksuid}"
+)
+
+// timePlaceholders are the time placeholders in the order they must appear.
+var timePlaceholders = []string{placeholderYear, placeholderMonth, placeholderDay, placeholderHour}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// KeyLayout is the template archive object keys are built from, e.g.
+// "archive/{topic}/{yyyy}/{mm}/{dd}/{hh}/{ksuid}".
+//
+// Time placeholders are filled in UTC from the object ksuid. The archive
+// extension is appended to the key.
+type KeyLayout struct {
+	template string
+	parts    []string
+	pattern  *regexp.Regexp
+}
+
+// NewKeyLayout parses a key layout template. The template must end with the
+// {ksuid} placeholder, and time placeholders must appear in order from year
+// to hour without gaps, so that keys sort by time.
+func NewKeyLayout(template string) (*KeyLayout, error) {
+	l := &KeyLayout{template: template}
+
+	seen := map[string]bool{}
+	next := 0
+	expr := "^"
+	rest := template
+	for rest != "" {
+		loc := placeholderPattern.FindStringIndex(rest)
+		if loc == nil {
+			l.parts = append(l.parts, rest)
+			expr += regexp.QuoteMeta(rest)
+			break
+		}
+
+		if loc[0] > 0 {
+			l.parts = append(l.parts, rest[:loc[0]])
+			expr += regexp.QuoteMeta(rest[:loc[0]])
+		}
+
+		p := rest[loc[0]:loc[1]]
+		if seen[p] {
+			return nil, fmt.Errorf("key layout: duplicate placeholder %s", p)
+		}
+		seen[p] = true
+
+		switch p {
+		case placeholderTopic:
+			expr += `([^/]+)`
+		case placeholderYear:
+			expr += `\d{4}`
+		case placeholderMonth, placeholderDay, placeholderHour:
+			expr += `\d{2}`
+		case placeholderKSUID:
+			expr += `([0-9A-Za-z]{27})`
+		default:
+			return nil, fmt.Errorf("key layout: unknown placeholder %s", p)
+		}
+
+		for i, tp := range timePlaceholders {
+			if tp != p {
+				continue
+			}
+			if i != next {
+				return nil, fmt.Errorf("key layout: %s must come after %s", p, timePlaceholders[i-1])
+			}
+			next = i + 1
+		}
+
+		l.parts = append(l.parts, p)
+		rest = rest[loc[1]:]
+	}
+
+	if len(l.parts) == 0 || l.parts[len(l.parts)-1] != placeholderKSUID {
+		return nil, fmt.Errorf("key layout: %q must end with %s", template, placeholderKSUID)
+	}
+
+	l.pattern = regexp.MustCompile(expr + `(\..*)?$`)
+
+	return l, nil
+}
+
+// String returns the layout template.
+func (l *KeyLayout) String() string {
+	return l.template
+}
+
+// HasTopic reports whether keys contain the message topic.
+func (l *KeyLayout) HasTopic() bool {
+	for _, p := range l.parts {
+		if p == placeholderTopic {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the key of an object without its extension.
+func (l *KeyLayout) Key(topic string, id ksuid.KSUID) string {
+	t := id.Time().UTC()
+
+	b := strings.Builder{}
+	for _, p := range l.parts {
+		switch p {
+		case placeholderTopic:
+			b.WriteString(url.PathEscape(topic))
+		case placeholderKSUID:
+			b.WriteString(id.String())
+		default:
+			if v, ok := timeValue(p, t); ok {
+				b.WriteString(v)
+				continue
+			}
+			b.WriteString(p)
+		}
+	}
+
+	return b.String()
+}
+
+// Parse returns the topic and time of an object from its key. The topic is
+// empty if the layout does not contain it.
+func (l *KeyLayout) Parse(key string) (string, time.Time, bool) {
+	m := l.pattern.FindStringSubmatch(key)
+	if m == nil {
+		return "", time.Time{}, false
+	}
+
+	topic := ""
+	i := 1
+	if l.HasTopic() {
+		t, err := url.PathUnescape(m[i])
+		if err != nil {
+			return "", time.Time{}, false
+		}
+		topic = t
+		i++
+	}
+
+	id, err := ksuid.Parse(m[i])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return topic, id.Time(), true
+}
+
+// legacyLayout is the layout of the flat objects at the root of the bucket,
+// written before a key layout was set.
+var legacyLayout, _ = NewKeyLayout(DefaultKeyLayout)
+
+// listing is a key range to list.
+type listing struct {
+	Prefix     string
+	StartAfter string
+	// Legacy lists the flat objects at the root of the bucket.
+	Legacy bool
+}
+
+// listings returns the key ranges to list for the filter, expanding the
+// template as far as the filter fixes its values. The keys of each range are
+// in time order if ordered is true.
+//
+// Unless a range covers the whole bucket, the flat objects at its root are
+// listed first, so that objects written before the layout was set are still
+// restored, in order before the newer objects.
+func (l *KeyLayout) listings(f Filter) (listings []listing, ordered bool) {
+	topics := []string{""}
+	if l.HasTopic() && literalPatterns(f.Include) {
+		topics = f.Include
+	}
+
+	var from, last time.Time
+	if !f.From.IsZero() && !f.To.IsZero() {
+		from = f.From.UTC()
+		last = f.To.Add(-time.Nanosecond).UTC()
+	}
+
+	ordered = true
+	listed := map[string]bool{}
+	var listedTopics []string
+	for _, topic := range topics {
+		b := strings.Builder{}
+
+		i := 0
+	parts:
+		for ; i < len(l.parts); i++ {
+			p := l.parts[i]
+			switch p {
+			case placeholderTopic:
+				if topic == "" {
+					break parts
+				}
+				b.WriteString(url.PathEscape(topic))
+
+			case placeholderKSUID:
+				break parts
+
+			default:
+				v, ok := timeValue(p, from)
+				if !ok {
+					b.WriteString(p)
+					continue
+				}
+				if w, _ := timeValue(p, last); from.IsZero() || v != w {
+					break parts
+				}
+				b.WriteString(v)
+			}
+		}
+
+		for _, p := range l.parts[i:] {
+			if p == placeholderTopic {
+				ordered = false
+			}
+		}
+
+		// topics that stop before the topic is written share their prefix,
+		// which is only listed once
+		if listed[b.String()] {
+			continue
+		}
+		listed[b.String()] = true
+
+		listings = append(listings, listing{Prefix: b.String()})
+		listedTopics = append(listedTopics, topic)
+	}
+
+	if ordered && !f.From.IsZero() {
+		if id, err := ksuid.FromParts(f.From, make([]byte, 16)); err == nil {
+			for i, topic := range listedTopics {
+				listings[i].StartAfter = l.Key(topic, id)
+			}
+		}
+	}
+
+	for _, ls := range listings {
+		if ls.Prefix == "" {
+			return listings, ordered
+		}
+	}
+
+	legacy := listing{Legacy: true}
+	if !f.From.IsZero() {
+		if id, err := ksuid.FromParts(f.From, make([]byte, 16)); err == nil {
+			legacy.StartAfter = legacyLayout.Key("", id)
+		}
+	}
+
+	return append([]listing{legacy}, listings...), ordered
+}
+
+func timeValue(p string, t time.Time) (string, bool) {
+	switch p {
+	case placeholderYear:
+		return fmt.Sprintf("%04d", t.Year()), true
+	case placeholderMonth:
+		return fmt.Sprintf("%02d", t.Month()), true
+	case placeholderDay:
+		return fmt.Sprintf("%02d", t.Day()), true
+	case placeholderHour:
+		return fmt.Sprintf("%02d", t.Hour()), true
+	}
+	return "", false
+}
+
+// literalPatterns reports whether the topic patterns are all plain topics.
+func literalPatterns(patterns []string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+
+	for _, p := range patterns {
+		if strings.ContainsAny(p, `*?[\`) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewKeyLayout(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  bool
+	}{
+		{DefaultKeyLayout, false},
+		{"archive/{topic}/{yyyy}/{mm}/{dd}/{hh}/{ksuid}", false},
+		{"{yyyy}/{topic}/{ksuid}", false},
+		{"archive/{topic}", true},
+		{"{ksuid}/{topic}", true},
+		{"{topic}/{topic}/{ksuid}", true},
+		{"{mm}/{yyyy}/{ksuid}", true},
+		{"{yyyy}/{dd}/{ksuid}", true},
+		{"{minute}/{ksuid}", true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewKeyLayout(tt.template)
+
+		assert.Equal(t, tt.wantErr, err != nil, tt.template)
+	}
+}
+
+func TestKeyLayout_KeyAndParse(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	id, _ := ksuid.NewRandomWithTime(ts)
+
+	l, err := NewKeyLayout("archive/{topic}/{yyyy}/{mm}/{dd}/{hh}/{ksuid}")
+	assert.NoError(t, err)
+
+	key := l.Key("orders", id)
+	assert.Equal(t, "archive/orders/2020/01/02/03/"+id.String(), key)
+
+	topic, got, ok := l.Parse(key + objectExt + CompressionGzip.Ext())
+	assert.True(t, ok)
+	assert.Equal(t, "orders", topic)
+	assert.True(t, ts.Equal(got))
+
+	_, _, ok = l.Parse(id.String() + ".json")
+	assert.False(t, ok)
+}
+
+func TestKeyLayout_ParseDefault(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	id, _ := ksuid.NewRandomWithTime(ts)
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+
+	topic, got, ok := l.Parse(id.String() + ".json")
+	assert.True(t, ok)
+	assert.Equal(t, "", topic)
+	assert.True(t, ts.Equal(got))
+}
+
+func TestKeyLayout_EscapesTopic(t *testing.T) {
+	id := ksuid.New()
+	l, _ := NewKeyLayout("{topic}/{ksuid}")
+
+	key := l.Key("a/b", id)
+	assert.Equal(t, "a%2Fb/"+id.String(), key)
+
+	topic, _, ok := l.Parse(key)
+	assert.True(t, ok)
+	assert.Equal(t, "a/b", topic)
+}
+
+func TestKeyLayout_listings(t *testing.T) {
+	from := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	l, _ := NewKeyLayout("archive/{topic}/{yyyy}/{mm}/{dd}/{hh}/{ksuid}")
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		prefixes []string
+		ordered  bool
+	}{
+		{
+			name:     "unbounded",
+			filter:   Filter{},
+			prefixes: []string{"archive/"},
+			ordered:  false,
+		},
+		{
+			name:     "topics",
+			filter:   Filter{Include: []string{"orders", "payments"}},
+			prefixes: []string{"archive/orders/", "archive/payments/"},
+			ordered:  true,
+		},
+		{
+			name:     "topic patterns",
+			filter:   Filter{Include: []string{"orders.*"}},
+			prefixes: []string{"archive/"},
+			ordered:  false,
+		},
+		{
+			name:     "hour",
+			filter:   Filter{From: from, To: from.Add(time.Hour), Include: []string{"orders"}},
+			prefixes: []string{"archive/orders/2020/01/02/03/"},
+			ordered:  true,
+		},
+		{
+			name:     "day",
+			filter:   Filter{From: from, To: from.Add(2 * time.Hour), Include: []string{"orders"}},
+			prefixes: []string{"archive/orders/2020/01/02/"},
+			ordered:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		listings, ordered := l.listings(tt.filter)
+
+		// the flat objects at the bucket root are listed first
+		if assert.True(t, len(listings) > 0 && listings[0].Legacy, tt.name) {
+			listings = listings[1:]
+		}
+
+		var prefixes []string
+		for _, l := range listings {
+			prefixes = append(prefixes, l.Prefix)
+		}
+		assert.Equal(t, tt.prefixes, prefixes, tt.name)
+		assert.Equal(t, tt.ordered, ordered, tt.name)
+	}
+}
+
+func TestKeyLayout_listingsTimeBeforeTopic(t *testing.T) {
+	from := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	l, _ := NewKeyLayout("archive/{yyyy}/{mm}/{topic}/{ksuid}")
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		prefixes []string
+	}{
+		{
+			name:     "unbounded",
+			filter:   Filter{Include: []string{"a", "b"}},
+			prefixes: []string{"archive/"},
+		},
+		{
+			name:     "different months",
+			filter:   Filter{From: from, To: from.AddDate(0, 2, 0), Include: []string{"a", "b"}},
+			prefixes: []string{"archive/2020/"},
+		},
+		{
+			name:     "month",
+			filter:   Filter{From: from, To: from.Add(time.Hour), Include: []string{"a", "b"}},
+			prefixes: []string{"archive/2020/01/a/", "archive/2020/01/b/"},
+		},
+	}
+
+	for _, tt := range tests {
+		listings, _ := l.listings(tt.filter)
+
+		if assert.True(t, len(listings) > 0 && listings[0].Legacy, tt.name) {
+			listings = listings[1:]
+		}
+
+		var prefixes []string
+		for _, l := range listings {
+			prefixes = append(prefixes, l.Prefix)
+		}
+		assert.Equal(t, tt.prefixes, prefixes, tt.name)
+	}
+}
+
+func TestKeyLayout_listingsStartAfter(t *testing.T) {
+	from := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+
+	listings, ordered := l.listings(Filter{From: from})
+
+	id, _ := ksuid.FromParts(from, make([]byte, 16))
+	assert.True(t, ordered)
+	assert.Equal(t, []listing{{StartAfter: id.String()}}, listings)
+}
+
+func TestKeyLayout_listingsLegacy(t *testing.T) {
+	from := time.Date(2020, 1, 2, 3, 0, 0, 0, time.UTC)
+	id, _ := ksuid.FromParts(from, make([]byte, 16))
+
+	l, _ := NewKeyLayout("{topic}/{ksuid}")
+
+	listings, _ := l.listings(Filter{})
+	assert.Equal(t, []listing{{}}, listings, "the root listing covers the flat objects")
+
+	listings, _ = l.listings(Filter{From: from, Include: []string{"orders"}})
+	assert.Equal(t, []listing{
+		{Legacy: true, StartAfter: id.String()},
+		{Prefix: "orders/", StartAfter: "orders/" + id.String()},
+	}, listings)
+}
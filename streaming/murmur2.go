@@ -0,0 +1,82 @@
+package streaming
+
+import (
+	"hash"
+)
+
+const (
+	murmur2Seed = 0x9747b28c
+	murmur2M    = 0x5bd1e995
+)
+
+// murmur2 is the 32-bit murmur2 hash used by the Kafka Java client to
+// partition keyed messages.
+type murmur2 struct {
+	data []byte
+}
+
+func newMurmur2() hash.Hash32 {
+	return &murmur2{}
+}
+
+// Write adds data to the hash.
+func (h *murmur2) Write(p []byte) (int, error) {
+	h.data = append(h.data, p...)
+	return len(p), nil
+}
+
+// Sum appends the hash to b.
+func (h *murmur2) Sum(b []byte) []byte {
+	s := h.Sum32()
+	return append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+// Sum32 returns the hash of the written data.
+func (h *murmur2) Sum32() uint32 {
+	data := h.data
+	length := len(data)
+	s := uint32(murmur2Seed) ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		k *= murmur2M
+		k ^= k >> 24
+		k *= murmur2M
+		s *= murmur2M
+		s ^= k
+	}
+
+	tail := length &^ 3
+	switch length % 4 {
+	case 3:
+		s ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		s ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		s ^= uint32(data[tail])
+		s *= murmur2M
+	}
+
+	s ^= s >> 13
+	s *= murmur2M
+	s ^= s >> 15
+
+	return s
+}
+
+// Reset resets the hash to its initial state.
+func (h *murmur2) Reset() {
+	h.data = h.data[:0]
+}
+
+// Size returns the number of bytes Sum returns.
+func (h *murmur2) Size() int {
+	return 4
+}
+
+// BlockSize returns the block size of the hash.
+func (h *murmur2) BlockSize() int {
+	return 4
+}
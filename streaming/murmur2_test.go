@@ -0,0 +1,30 @@
+package streaming
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_murmur2(t *testing.T) {
+	// Values from the Kafka Java client tests
+	tests := []struct {
+		data string
+		want int32
+	}{
+		{"21", -973932308},
+		{"foobar", -790332482},
+		{"a-little-bit-long-string", -985981536},
+		{"a-little-bit-longer-string", -1486304829},
+		{"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8", -58897971},
+		{"abc", 479470107},
+	}
+
+	h := newMurmur2()
+	for _, tt := range tests {
+		h.Reset()
+		h.Write([]byte(tt.data))
+
+		assert.Equal(t, tt.want, int32(h.Sum32()), tt.data)
+	}
+}
@@ -0,0 +1,329 @@
+package streaming
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/segmentio/ksuid"
+)
+
+// RestoredMode is what is done with archive objects once they are restored.
+type RestoredMode string
+
+// Restored object modes.
+const (
+	// RestoredDelete deletes restored objects.
+	RestoredDelete RestoredMode = "delete"
+	// RestoredMove moves restored objects under a prefix, possibly in
+	// another bucket.
+	RestoredMove RestoredMode = "move"
+	// RestoredTag tags restored objects and leaves them in place.
+	RestoredTag RestoredMode = "tag"
+)
+
+// DefaultRestoredPrefix is the prefix restored objects are moved under.
+const DefaultRestoredPrefix = "restored/"
+
+// Restore metadata keys, as object metadata of moved objects and as tags of
+// tagged objects.
+const (
+	restoredAtMetadata       = "Restored-At"
+	restoreRunMetadata       = "Restore-Run"
+	restoredMessagesMetadata = "Restored-Messages"
+)
+
+// Restored configures what is done with restored archive objects.
+type Restored struct {
+	Mode RestoredMode
+	// Bucket is the bucket objects are moved to. Defaults to the archive bucket.
+	Bucket string
+	// Prefix is the prefix objects are moved under. Keys under it in the
+	// archive bucket are never restored, whatever the mode. Defaults to
+	// DefaultRestoredPrefix unless objects are moved.
+	Prefix string
+	// RunID identifies the restore in the restore metadata. A ksuid is
+	// generated if empty.
+	RunID string
+}
+
+// validate checks the configuration and sets its defaults for the archive bucket.
+func (r *Restored) validate(bucket string) error {
+	if r.Bucket == "" {
+		r.Bucket = bucket
+	}
+
+	switch r.Mode {
+	case "":
+		r.Mode = RestoredDelete
+		fallthrough
+	case RestoredDelete, RestoredTag:
+		// keep skipping the objects an earlier run moved
+		if r.Prefix == "" {
+			r.Prefix = DefaultRestoredPrefix
+		}
+	case RestoredMove:
+		if r.Bucket == bucket && r.Prefix == "" {
+			return errors.New("restored: a prefix is needed to move objects within the archive bucket")
+		}
+	default:
+		return fmt.Errorf("restored: unknown mode %q", r.Mode)
+	}
+
+	if r.RunID == "" {
+		r.RunID = ksuid.New().String()
+	}
+
+	return nil
+}
+
+// moved reports whether the key is under the restored prefix of the archive
+// bucket. Such keys are skipped whatever the mode, since an earlier restore
+// may have moved objects there.
+func (r Restored) moved(bucket, key string) bool {
+	return r.Bucket == bucket && r.Prefix != "" && strings.HasPrefix(key, r.Prefix)
+}
+
+// movedKey returns the key an object is moved to. Moved objects are kept
+// per restore run, so that restoring the rest of an object does not
+// overwrite the copy of an earlier run.
+func (r Restored) movedKey(key string) string {
+	return r.Prefix + r.RunID + "/" + key
+}
+
+// metadata returns the restore metadata of an object.
+func (r Restored) metadata(t time.Time, messages int) map[string]string {
+	return map[string]string{
+		restoredAtMetadata:       t.UTC().Format(time.RFC3339),
+		restoreRunMetadata:       r.RunID,
+		restoredMessagesMetadata: strconv.Itoa(messages),
+	}
+}
+
+// WithS3Restored sets what is done with restored objects. Objects are
+// deleted by default.
+func WithS3Restored(r Restored) S3ConsumerOptFunc {
+	return S3ConsumerOptFunc(func(c *s3Consumer) {
+		c.restored = r
+	})
+}
+
+// finish handles an object whose matched messages have been restored.
+// Objects with unmatched messages are rewritten with only those, keeping a
+// copy of the original when objects are moved or tagged.
+func (c *s3Consumer) finish(key string, f Filter, unmatched, matched int, codec Compression) {
+	if c.isClosed() {
+		return
+	}
+
+	var err error
+	switch c.restored.Mode {
+	case RestoredMove:
+		err = c.move(key, matched, codec, unmatched == 0)
+	case RestoredTag:
+		// a rewritten object still holds messages to restore, so the
+		// original is kept as a tagged copy instead
+		if unmatched == 0 {
+			err = c.tag(key, matched)
+		} else {
+			err = c.tagCopy(key, matched, codec)
+		}
+	}
+	if err != nil {
+		c.error(err)
+		return
+	}
+
+	if unmatched > 0 {
+		c.rewrite(key, f, codec)
+		return
+	}
+	if c.restored.Mode == RestoredDelete {
+		c.remove(key)
+	}
+}
+
+// move copies an object under the restored prefix and run ID with its
+// restore metadata, removing the original if remove is true.
+func (c *s3Consumer) move(key string, matched int, codec Compression, remove bool) error {
+	metadata := map[string]*string{compressionMetadata: aws.String(string(codec))}
+	for k, v := range c.restored.metadata(time.Now(), matched) {
+		metadata[k] = aws.String(v)
+	}
+
+	source := (&url.URL{Path: c.bucket + "/" + key}).EscapedPath()
+	_, err := c.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(c.restored.Bucket),
+		Key:               aws.String(c.restored.movedKey(key)),
+		CopySource:        aws.String(source),
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	if err != nil {
+		return err
+	}
+
+	if remove {
+		c.remove(key)
+	}
+	return nil
+}
+
+// tag sets the restore metadata of an object as its tags.
+func (c *s3Consumer) tag(key string, matched int) error {
+	tagging := &s3.Tagging{}
+	for k, v := range c.restored.metadata(time.Now(), matched) {
+		tagging.TagSet = append(tagging.TagSet, &s3.Tag{Key: aws.String(strings.ToLower(k)), Value: aws.String(v)})
+	}
+
+	_, err := c.client.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(c.bucket),
+		Key:     aws.String(key),
+		Tagging: tagging,
+	})
+	return err
+}
+
+// tagCopy copies an object under the restored prefix and run ID with its
+// restore metadata as tags.
+func (c *s3Consumer) tagCopy(key string, matched int, codec Compression) error {
+	tags := url.Values{}
+	for k, v := range c.restored.metadata(time.Now(), matched) {
+		tags.Set(strings.ToLower(k), v)
+	}
+
+	source := (&url.URL{Path: c.bucket + "/" + key}).EscapedPath()
+	_, err := c.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(c.bucket),
+		Key:               aws.String(c.restored.movedKey(key)),
+		CopySource:        aws.String(source),
+		Metadata:          map[string]*string{compressionMetadata: aws.String(string(codec))},
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		Tagging:           aws.String(tags.Encode()),
+		TaggingDirective:  aws.String(s3.TaggingDirectiveReplace),
+	})
+	return err
+}
+
+// restoredAt returns the restore time of a tagged object.
+func restoredAt(client *s3.S3, bucket, key string) (time.Time, bool, error) {
+	out, err := client.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	for _, tag := range out.TagSet {
+		if aws.StringValue(tag.Key) != strings.ToLower(restoredAtMetadata) {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, aws.StringValue(tag.Value))
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("restored: object %s: %v", key, err)
+		}
+		return t, true, nil
+	}
+
+	return time.Time{}, false, nil
+}
+
+// movedAt returns the restore time of a moved object.
+func movedAt(client *s3.S3, bucket, key string) (time.Time, bool, error) {
+	out, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	v, ok := out.Metadata[restoredAtMetadata]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, aws.StringValue(v))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("restored: object %s: %v", key, err)
+	}
+	return t, true, nil
+}
+
+// S3Cleaner removes restored objects once their retention has passed.
+type S3Cleaner struct {
+	client   *s3.S3
+	bucket   string
+	restored Restored
+}
+
+// NewS3Cleaner creates a cleaner of the objects restored from the archive
+// bucket.
+func NewS3Cleaner(endpoint, region, bucket string, restored Restored) (*S3Cleaner, error) {
+	if err := restored.validate(bucket); err != nil {
+		return nil, err
+	}
+	if restored.Mode == RestoredDelete {
+		return nil, errors.New("restored: deleted objects need no cleanup")
+	}
+
+	sess, err := newS3Session(endpoint, region)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Cleaner{
+		client:   s3.New(sess),
+		bucket:   bucket,
+		restored: restored,
+	}, nil
+}
+
+// Clean removes the objects restored before the given time, calling fn with
+// the key of each object removed. Only objects carrying the restore time are
+// removed, so other objects under the restored prefix or in the restored
+// bucket are kept. Nothing is removed if dryRun is true.
+func (c *S3Cleaner) Clean(before time.Time, dryRun bool, fn func(key string)) error {
+	bucket, prefix := c.bucket, ""
+	if c.restored.Mode == RestoredMove {
+		bucket, prefix = c.restored.Bucket, c.restored.Prefix
+	}
+
+	var cleanErr error
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}
+	err := c.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			key := aws.StringValue(item.Key)
+
+			var t time.Time
+			var ok bool
+			if c.restored.Mode == RestoredMove {
+				t, ok, cleanErr = movedAt(c.client, bucket, key)
+			} else {
+				t, ok, cleanErr = restoredAt(c.client, bucket, key)
+			}
+			if cleanErr != nil {
+				return false
+			}
+			if !ok || !t.Before(before) {
+				continue
+			}
+
+			if !dryRun {
+				_, cleanErr = c.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+				if cleanErr != nil {
+					return false
+				}
+			}
+			fn(key)
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return cleanErr
+}
@@ -0,0 +1,63 @@
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestored_validate(t *testing.T) {
+	r := Restored{}
+	assert.NoError(t, r.validate("archive"))
+	assert.Equal(t, RestoredDelete, r.Mode)
+	assert.Equal(t, "archive", r.Bucket)
+	assert.Equal(t, DefaultRestoredPrefix, r.Prefix)
+	assert.NotEmpty(t, r.RunID)
+
+	r = Restored{Mode: RestoredMove, Prefix: DefaultRestoredPrefix, RunID: "run"}
+	assert.NoError(t, r.validate("archive"))
+	assert.Equal(t, "archive", r.Bucket)
+	assert.Equal(t, "run", r.RunID)
+
+	r = Restored{Mode: RestoredMove, Bucket: "audit"}
+	assert.NoError(t, r.validate("archive"))
+
+	r = Restored{Mode: RestoredMove}
+	assert.Error(t, r.validate("archive"))
+
+	r = Restored{Mode: "archive"}
+	assert.Error(t, r.validate("archive"))
+}
+
+func TestRestored_moved(t *testing.T) {
+	r := Restored{Mode: RestoredMove, Bucket: "archive", Prefix: "restored/"}
+
+	assert.True(t, r.moved("archive", "restored/1TbUlL7RQzAuLDSWfWhgdwSbzR0.ndjson"))
+	assert.False(t, r.moved("archive", "1TbUlL7RQzAuLDSWfWhgdwSbzR0.ndjson"))
+	assert.False(t, r.moved("other", "restored/1TbUlL7RQzAuLDSWfWhgdwSbzR0.ndjson"))
+
+	// keys under the prefix are skipped whatever the mode
+	r.Mode = RestoredDelete
+	assert.True(t, r.moved("archive", "restored/1TbUlL7RQzAuLDSWfWhgdwSbzR0.ndjson"))
+
+	r.Prefix = ""
+	assert.False(t, r.moved("archive", "1TbUlL7RQzAuLDSWfWhgdwSbzR0.ndjson"))
+}
+
+func TestRestored_movedKey(t *testing.T) {
+	r := Restored{Mode: RestoredMove, Prefix: "restored/", RunID: "run"}
+
+	assert.Equal(t, "restored/run/orders/1TbUlL7RQzAuLDSWfWhgdwSbzR0.ndjson", r.movedKey("orders/1TbUlL7RQzAuLDSWfWhgdwSbzR0.ndjson"))
+}
+
+func TestRestored_metadata(t *testing.T) {
+	r := Restored{RunID: "run"}
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+
+	assert.Equal(t, map[string]string{
+		"Restored-At":       "2020-01-02T02:04:05Z",
+		"Restore-Run":       "run",
+		"Restored-Messages": "42",
+	}, r.metadata(at, 42))
+}
@@ -1,22 +1,39 @@
 package streaming
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/segmentio/ksuid"
-	"io/ioutil"
 )
 
+// S3OptFunc represents a configuration function for the S3 producer.
+type S3OptFunc func(p *s3Producer)
+
+// WithS3Name sets the name of the producer.
+func WithS3Name(name string) S3OptFunc {
+	return S3OptFunc(func(p *s3Producer) {
+		p.name = name
+	})
+}
+
 type s3Producer struct {
-	client *s3.S3
-	bucket string
+	name        string
+	client      *s3.S3
+	uploader    *s3manager.Uploader
+	bucket      string
+	compression Compression
+	layout      *KeyLayout
 
 	buffer     []*Message
 	timer      <-chan time.Time
@@ -33,25 +50,28 @@ type s3Producer struct {
 }
 
 // NewS3Producer creates a producer that sends messages to AWS S3.
-func NewS3Producer(endpoint, region, bucket string) (Producer, error) {
-	// Configure to use Minio Server
-	config := &aws.Config{
-		Region: aws.String(region),
-	}
-	if endpoint != "" {
-		config.Endpoint = aws.String(endpoint)
-		config.DisableSSL = aws.Bool(!strings.Contains(endpoint, "https"))
-		config.S3ForcePathStyle = aws.Bool(true)
+//
+// Archive objects are compressed with the given codec, which is recorded in
+// the key extension and the object metadata. Object keys are built from the
+// layout; batches are split per topic if the layout contains the topic.
+func NewS3Producer(endpoint, region, bucket string, compression Compression, layout *KeyLayout, opts ...S3OptFunc) (Producer, error) {
+	if err := compression.Validate(); err != nil {
+		return nil, err
 	}
 
-	sess, err := session.NewSession(config)
+	sess, err := newS3Session(endpoint, region)
 	if err != nil {
 		return nil, err
 	}
 
+	client := s3.New(sess)
 	p := &s3Producer{
-		client:         s3.New(sess),
+		name:           "s3",
+		client:         client,
+		uploader:       s3manager.NewUploaderWithClient(client),
 		bucket:         bucket,
+		compression:    compression,
+		layout:         layout,
 		input:          make(chan *Message),
 		output:         make(chan Messages, 10),
 		errors:         make(chan *Error),
@@ -59,6 +79,10 @@ func NewS3Producer(endpoint, region, bucket string) (Producer, error) {
 		FlushFrequency: 5 * time.Second,
 	}
 
+	for _, opt := range opts {
+		opt(p)
+	}
+
 	go p.dispatchMessages()
 	go p.dispatchFiles()
 
@@ -67,7 +91,7 @@ func NewS3Producer(endpoint, region, bucket string) (Producer, error) {
 
 // Name is the name of the producer.
 func (p *s3Producer) Name() string {
-	return "s3"
+	return p.name
 }
 
 // Input is the message input channel.
@@ -143,44 +167,71 @@ func (p *s3Producer) dispatchFiles() {
 	p.outputWg.Add(1)
 	defer p.outputWg.Done()
 
-	for msgs := range p.output {
-		b, err := json.Marshal(&msgs)
-		if err != nil {
-			p.errors <- &Error{
-				Msgs: msgs,
-				Err:  err,
-			}
-			continue
-		}
+	for batch := range p.output {
+		for _, msgs := range p.split(batch) {
+			key := p.layout.Key(msgs[0].Topic, ksuid.New()) + objectExt + p.compression.Ext()
 
-		key := aws.String(ksuid.New().String() + ".json")
+			if err := p.upload(key, msgs); err != nil {
+				p.errors <- &Error{
+					Msgs: msgs,
+					Err:  err,
+				}
+				continue
+			}
 
-		_, err = p.client.PutObject(&s3.PutObjectInput{
-			Body:   bytes.NewReader(b),
-			Bucket: aws.String(p.bucket),
-			Key:    key,
-		})
-		if err != nil {
-			p.errors <- &Error{
-				Msgs: msgs,
-				Err:  err,
+			for _, msg := range msgs {
+				msg.Acknowledge(p.Name())
 			}
 		}
 	}
 }
 
-func newMessageBuffer(cap int) []*Message {
-	return make([]*Message, 0, cap)
+// split splits a batch into one object per topic if the layout contains the
+// topic, keeping the order of the messages.
+func (p *s3Producer) split(msgs Messages) []Messages {
+	if !p.layout.HasTopic() {
+		return []Messages{msgs}
+	}
+
+	var objects []Messages
+	index := map[string]int{}
+	for _, msg := range msgs {
+		i, ok := index[msg.Topic]
+		if !ok {
+			i = len(objects)
+			index[msg.Topic] = i
+			objects = append(objects, Messages{})
+		}
+		objects[i] = append(objects[i], msg)
+	}
+
+	return objects
 }
 
-type s3Consumer struct {
-	sess   *session.Session
-	client *s3.S3
-	bucket string
+// upload streams the messages to an archive object as they are encoded.
+func (p *s3Producer) upload(key string, msgs Messages) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeObject(pw, msgs, p.compression))
+	}()
+
+	_, err := p.uploader.Upload(&s3manager.UploadInput{
+		Body:     pr,
+		Bucket:   aws.String(p.bucket),
+		Key:      aws.String(key),
+		Metadata: map[string]*string{compressionMetadata: aws.String(string(p.compression))},
+	})
+	pr.CloseWithError(err)
+
+	return err
 }
 
-// NewS3Consumer creates a consumer that gets messages to AWS S3.
-func NewS3Consumer(endpoint, region, bucket string) (Consumer, error) {
+// objectExt is the key extension of newline delimited archive objects.
+const objectExt = ".ndjson"
+
+// newS3Session creates an AWS session for the region, using the endpoint
+// if set.
+func newS3Session(endpoint, region string) (*session.Session, error) {
 	// Configure to use Minio Server
 	config := &aws.Config{
 		Region: aws.String(region),
@@ -191,75 +242,562 @@ func NewS3Consumer(endpoint, region, bucket string) (Consumer, error) {
 		config.S3ForcePathStyle = aws.Bool(true)
 	}
 
-	sess, err := session.NewSession(config)
+	return session.NewSession(config)
+}
+
+// compressionMetadata is the object metadata key recording the archive codec.
+const compressionMetadata = "Compression"
+
+func newMessageBuffer(cap int) []*Message {
+	return make([]*Message, 0, cap)
+}
+
+// objectTime returns the time an archive object was written, taken from its
+// ksuid key and falling back to its modification time.
+func objectTime(key string, modified time.Time) time.Time {
+	name := path.Base(key)
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+
+	if id, err := ksuid.Parse(name); err == nil {
+		return id.Time()
+	}
+	return modified
+}
+
+// S3ConsumerOptFunc represents a configuration function for the S3 consumer.
+type S3ConsumerOptFunc func(c *s3Consumer)
+
+// WithS3Concurrency sets the number of objects downloaded and decoded in
+// parallel. Messages are still output in the order of the objects.
+func WithS3Concurrency(n int) S3ConsumerOptFunc {
+	return S3ConsumerOptFunc(func(c *s3Consumer) {
+		c.concurrency = n
+	})
+}
+
+// WithS3Checkpoint keeps the restore progress in the checkpoint store. If
+// resume is true, objects done according to the saved checkpoint are skipped.
+func WithS3Checkpoint(store CheckpointStore, resume bool) S3ConsumerOptFunc {
+	return S3ConsumerOptFunc(func(c *s3Consumer) {
+		c.checkpoints = store
+		c.resume = resume
+	})
+}
+
+// WithS3ReadOnly makes the consumer leave the bucket untouched: no object is
+// removed, rewritten, moved or tagged, even once its messages are
+// acknowledged. A checkpoint store is then only used to skip its marker
+// object; the checkpoint is neither resumed nor saved.
+func WithS3ReadOnly() S3ConsumerOptFunc {
+	return S3ConsumerOptFunc(func(c *s3Consumer) {
+		c.readOnly = true
+	})
+}
+
+type s3Consumer struct {
+	sess   *session.Session
+	client *s3.S3
+	bucket string
+	layout *KeyLayout
+
+	uploader    *s3manager.Uploader
+	concurrency int
+	readOnly    bool
+	restored    Restored
+	checkpoints CheckpointStore
+	resume      bool
+	checkpoint  *checkpointer
+
+	objects  int64
+	errors   chan error
+	errorsMu sync.RWMutex
+	closed   bool
+	done     chan struct{}
+	outputWg sync.WaitGroup
+}
+
+// NewS3Consumer creates a consumer that gets messages to AWS S3.
+//
+// Objects are only deleted, moved or tagged as restored once every message
+// they contain has been acknowledged by a producer. Objects are listed by the
+// key prefixes the layout and filter allow.
+func NewS3Consumer(endpoint, region, bucket string, layout *KeyLayout, opts ...S3ConsumerOptFunc) (Consumer, error) {
+	sess, err := newS3Session(endpoint, region)
 	if err != nil {
 		return nil, err
 	}
 
 	c := &s3Consumer{
-		sess:   sess,
-		client: s3.New(sess),
-		bucket: bucket,
+		sess:        sess,
+		client:      s3.New(sess),
+		bucket:      bucket,
+		layout:      layout,
+		concurrency: 1,
+		errors:      make(chan error, 10),
+		done:        make(chan struct{}),
+	}
+	c.uploader = s3manager.NewUploaderWithClient(c.client)
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.concurrency < 1 {
+		return nil, errors.New("s3: concurrency must be at least 1")
+	}
+	if err := c.restored.validate(bucket); err != nil {
+		return nil, err
+	}
+
+	if c.checkpoints != nil && !c.readOnly {
+		c.checkpoint, err = newCheckpointer(c.checkpoints, c.resume, c.error)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return c, nil
 }
 
-// Output gets messages until the given date.
-func (c *s3Consumer) Output(t time.Time) (<-chan Messages, <-chan error) {
+// Output gets the messages passing the filter.
+//
+// Objects are downloaded in parallel up to the consumer concurrency, and
+// their messages are output one object after the other in listing order, so
+// that the order of messages with the same key is kept.
+func (c *s3Consumer) Output(f Filter) (<-chan Messages, <-chan error) {
 	ch := make(chan Messages, 10)
-	errors := make(chan error, 10)
+	downloads := make(chan *download, c.concurrency-1)
 
+	c.outputWg.Add(2)
 	go func() {
+		defer c.outputWg.Done()
 		defer close(ch)
-		defer close(errors)
 
-		resp, err := c.client.ListObjects(&s3.ListObjectsInput{Bucket: aws.String(c.bucket)})
+		for d := range downloads {
+			sent := false
+			for msgs := range d.out {
+				select {
+				case ch <- msgs:
+					sent = true
+				case <-c.done:
+					return
+				}
+			}
+
+			if sent {
+				atomic.AddInt64(&c.objects, 1)
+			}
+		}
+	}()
+
+	go func() {
+		defer c.outputWg.Done()
+		defer close(downloads)
+
+		err := c.walk(f, func(obj archiveObject) bool {
+			d := &download{key: obj.key, out: make(chan Messages, 1)}
+			select {
+			case downloads <- d:
+			case <-c.done:
+				return false
+			}
+
+			var o *checkpointObject
+			switch {
+			case c.checkpoint == nil:
+			case obj.retry:
+				o = c.checkpoint.startRetry(obj.key)
+			default:
+				o = c.checkpoint.start(obj.listing, obj.prefix, obj.key)
+			}
+
+			c.outputWg.Add(1)
+			go func() {
+				defer c.outputWg.Done()
+				defer close(d.out)
+
+				c.consume(d.out, d.key, f, o)
+			}()
+
+			return true
+		})
 		if err != nil {
-			return
+			c.error(err)
 		}
+	}()
+
+	return ch, c.errors
+}
+
+// download is an object being consumed.
+type download struct {
+	key string
+	out chan Messages
+}
 
-		// loop bucket objects
-		for _, item := range resp.Contents {
-			if item.LastModified.After(t) {
-				// since ksuid are sorted by timestamp, we can stop here
-				break
+// archiveObject is a listed archive object. A retried object failed in the
+// resumed run and is not listed.
+type archiveObject struct {
+	listing int
+	prefix  string
+	key     string
+	size    int64
+	time    time.Time
+	retry   bool
+}
+
+// walk lists the archive objects in the key ranges and time range of the
+// filter, in key range and key order, calling fn with each object. Objects
+// done according to the checkpoint are skipped, and the ones that failed
+// are retried first. The walk stops when fn returns false.
+func (c *s3Consumer) walk(f Filter, fn func(obj archiveObject) bool) error {
+	if c.checkpoint != nil {
+		for _, key := range c.checkpoint.retries() {
+			if !fn(archiveObject{key: key, retry: true}) {
+				return nil
 			}
-			object, err := c.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(c.bucket), Key: item.Key})
+		}
+	}
+
+	listings, ordered := c.layout.listings(f)
+	for i, l := range listings {
+		if c.checkpoint != nil {
+			after, done, err := c.checkpoint.resume(i, l.Prefix)
 			if err != nil {
+				return err
+			}
+			if done {
 				continue
 			}
+			if after > l.StartAfter {
+				l.StartAfter = after
+			}
+		}
 
-			msgs := Messages{}
-			buf, err := ioutil.ReadAll(object.Body)
-			if err != nil {
-				errors <- err
+		stopped, err := c.list(i, l, ordered, f, fn)
+		if err != nil || stopped {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// list lists the archive objects of a key range, calling fn with each
+// object. It returns true if fn stopped the listing.
+func (c *s3Consumer) list(i int, l listing, ordered bool, f Filter, fn func(obj archiveObject) bool) (bool, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(c.bucket), Prefix: aws.String(l.Prefix)}
+	if l.StartAfter != "" {
+		input.StartAfter = aws.String(l.StartAfter)
+	}
+	layout := c.layout
+	if l.Legacy {
+		// only the objects at the root, not the objects of the layout
+		input.Delimiter = aws.String("/")
+		layout = legacyLayout
+	}
+
+	stopped := false
+	err := c.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, item := range page.Contents {
+			if c.isCheckpoint(*item.Key) || c.restored.moved(c.bucket, *item.Key) {
 				continue
 			}
-
-			err = json.Unmarshal(buf, &msgs)
-			if err != nil {
-				errors <- err
+			if c.checkpoint != nil && c.checkpoint.skipped(i, l.Prefix, *item.Key) {
 				continue
 			}
 
-			_, err = c.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(c.bucket), Key: item.Key})
-			if err != nil {
-				errors <- err
+			topic, t, ok := layout.Parse(*item.Key)
+			if !ok && l.Legacy {
+				continue
+			}
+			if !ok {
+				t = objectTime(*item.Key, *item.LastModified)
+			}
+			if topic != "" && !f.MatchTopic(topic) {
+				continue
+			}
+			if f.Before(t) {
+				continue
+			}
+			if f.After(t) {
+				if ordered {
+					// since the keys are sorted by time, we can stop here
+					return false
+				}
 				continue
 			}
 
-			ch <- msgs
+			obj := archiveObject{
+				listing: i,
+				prefix:  l.Prefix,
+				key:     *item.Key,
+				size:    aws.Int64Value(item.Size),
+				time:    t,
+			}
+			if !fn(obj) {
+				stopped = true
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return stopped, err
+}
+
+// consumeChunk is the number of messages decoded from an object at a time.
+const consumeChunk = 1000
+
+// consume reads an object and sends its messages passing the filter to the
+// channel as they are decoded. The checkpoint object, if any, is done once
+// the object needs no more work, and failed when the object cannot be read
+// or one of its messages is rejected.
+func (c *s3Consumer) consume(ch chan<- Messages, key string, f Filter, o *checkpointObject) {
+	// an earlier restore may have tagged the object, whatever the mode
+	_, tagged, err := restoredAt(c.client, c.bucket, key)
+	if err != nil {
+		c.checkpointFailed(o)
+		c.error(err)
+		return
+	}
+	if tagged {
+		c.checkpointDone(o, 0)
+		return
+	}
+
+	r, codec, err := c.open(key)
+	if err != nil {
+		c.checkpointFailed(o)
+		c.error(err)
+		return
+	}
+	defer r.Close()
+
+	tracker := newAckTracker()
+	total, matched := 0, 0
+	for {
+		msgs, err := r.Next(consumeChunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// keep the object, it cannot be rewritten without its messages
+			tracker.seal(nil)
+			c.checkpointFailed(o)
+			c.error(err)
+			return
+		}
+		total += len(msgs)
+
+		m, _ := f.Split(msgs)
+		if len(m) == 0 {
+			continue
+		}
+		matched += len(m)
+		tracker.track(m)
+		for _, msg := range m {
+			msg.Nack = func(error) {
+				c.checkpointFailed(o)
+			}
+		}
+
+		select {
+		case ch <- m:
+		case <-c.done:
+			tracker.seal(nil)
+			return
 		}
+	}
+
+	switch {
+	case c.readOnly:
+		tracker.seal(nil)
+	case total == 0:
+		tracker.seal(nil)
+		c.remove(key)
+		c.checkpointDone(o, 0)
+	case matched == 0:
+		tracker.seal(nil)
+		c.checkpointDone(o, 0)
+	default:
+		tracker.seal(func() {
+			c.finish(key, f, total-matched, matched, codec)
+			c.checkpointDone(o, matched)
+		})
+	}
+}
+
+// checkpointDone records that an object needs no more work.
+func (c *s3Consumer) checkpointDone(o *checkpointObject, messages int) {
+	if o == nil {
+		return
+	}
+	c.checkpoint.done(o, messages)
+}
+
+// checkpointFailed records that an object could not be restored.
+func (c *s3Consumer) checkpointFailed(o *checkpointObject) {
+	if o == nil {
+		return
+	}
+	c.checkpoint.fail(o)
+}
+
+// isCheckpoint reports whether the key is the checkpoint marker object.
+func (c *s3Consumer) isCheckpoint(key string) bool {
+	s, ok := c.checkpoints.(*s3CheckpointStore)
+	return ok && s.bucket == c.bucket && s.key == key
+}
+
+// open downloads an object and returns a reader decoding its messages. The
+// codec is detected from the key extension, falling back to the object
+// metadata.
+func (c *s3Consumer) open(key string) (*objectReader, Compression, error) {
+	object, err := c.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(c.bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, "", err
+	}
+
+	codec, ok := compressionFromKey(key)
+	if v, found := object.Metadata[compressionMetadata]; !ok && found && v != nil {
+		codec = Compression(*v)
+	}
+
+	r, err := newObjectReader(object.Body, codec)
+	if err != nil {
+		object.Body.Close()
+		return nil, "", err
+	}
+
+	return r, codec, nil
+}
+
+// remove deletes an object from the bucket.
+func (c *s3Consumer) remove(key string) {
+	if c.isClosed() {
+		return
+	}
+
+	_, err := c.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(c.bucket), Key: aws.String(key)})
+	if err != nil {
+		c.error(err)
+	}
+}
+
+// rewrite replaces an object with the messages that do not pass the
+// filter. The object is read again and its remaining messages are streamed
+// to the new object, so they are never held in memory at once. The object
+// is left as it was if the rewrite fails, so its restored messages are
+// restored again by the next restore.
+func (c *s3Consumer) rewrite(key string, f Filter, codec Compression) {
+	if c.isClosed() {
+		return
+	}
+
+	err := c.writeRest(key, f, codec)
+	if err != nil {
+		c.error(fmt.Errorf("s3: rewrite %s, its restored messages will be restored again: %v", key, err))
+	}
+}
+
+func (c *s3Consumer) writeRest(key string, f Filter, codec Compression) error {
+	r, _, err := c.open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeRest(pw, r, f, codec))
 	}()
 
-	return ch, errors
+	_, err = c.uploader.Upload(&s3manager.UploadInput{
+		Body:     pr,
+		Bucket:   aws.String(c.bucket),
+		Key:      aws.String(key),
+		Metadata: map[string]*string{compressionMetadata: aws.String(string(codec))},
+	})
+	pr.CloseWithError(err)
+
+	return err
 }
 
+// writeRest writes the messages of an object that do not pass the filter
+// as an archive object.
+func writeRest(w io.Writer, r *objectReader, f Filter, codec Compression) error {
+	ow, err := newObjectWriter(w, codec)
+	if err != nil {
+		return err
+	}
+
+	for {
+		msgs, err := r.Next(consumeChunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		_, rest := f.Split(msgs)
+		if err := ow.Write(rest); err != nil {
+			return err
+		}
+	}
+
+	return ow.Close()
+}
+
+// error reports an error unless the consumer has been closed.
+func (c *s3Consumer) error(err error) {
+	c.errorsMu.RLock()
+	defer c.errorsMu.RUnlock()
+
+	if c.closed {
+		return
+	}
+	c.errors <- err
+}
+
+func (c *s3Consumer) isClosed() bool {
+	c.errorsMu.RLock()
+	defer c.errorsMu.RUnlock()
+
+	return c.closed
+}
+
+// Close closes the consumer.
+//
+// Messages acknowledged after Close will not remove their object.
 func (c *s3Consumer) Close() error {
+	close(c.done)
+	c.outputWg.Wait()
+
+	if c.checkpoint != nil {
+		if err := c.checkpoint.Close(); err != nil {
+			c.error(err)
+		}
+	}
+
+	c.errorsMu.Lock()
+	c.closed = true
+	close(c.errors)
+	c.errorsMu.Unlock()
+
 	return nil
 }
 
+// Objects returns the number of objects messages have been output from.
+func (c *s3Consumer) Objects() int {
+	return int(atomic.LoadInt64(&c.objects))
+}
+
+// IsHealthy checks the health of the Consumer.
 func (c *s3Consumer) IsHealthy() bool {
 	return true
 }
@@ -0,0 +1,710 @@
+package streaming
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_objectTime(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	modified := ts.Add(time.Hour)
+	id, _ := ksuid.NewRandomWithTime(ts)
+
+	assert.True(t, ts.Equal(objectTime(id.String()+".json", modified)))
+	assert.True(t, modified.Equal(objectTime("not-a-ksuid.json", modified)))
+}
+
+func Test_compressionFromKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		codec Compression
+		found bool
+	}{
+		{"id.json", CompressionNone, false},
+		{"id.json.gz", CompressionGzip, true},
+		{"id.json.zst", CompressionZstd, true},
+		{"id.json.sz", CompressionSnappy, true},
+	}
+
+	for _, tt := range tests {
+		codec, found := compressionFromKey(tt.key)
+
+		assert.Equal(t, tt.codec, codec, tt.key)
+		assert.Equal(t, tt.found, found, tt.key)
+	}
+}
+
+func TestCompression_Validate(t *testing.T) {
+	assert.NoError(t, CompressionZstd.Validate())
+	assert.Error(t, Compression("lzma").Validate())
+}
+
+func TestS3Producer_split(t *testing.T) {
+	l, _ := NewKeyLayout("{topic}/{ksuid}")
+	p := &s3Producer{layout: l}
+
+	a1, b1, a2 := &Message{Topic: "a"}, &Message{Topic: "b"}, &Message{Topic: "a"}
+	objects := p.split(Messages{a1, b1, a2})
+
+	assert.Equal(t, []Messages{{a1, a2}, {b1}}, objects)
+
+	p.layout, _ = NewKeyLayout(DefaultKeyLayout)
+	assert.Len(t, p.split(Messages{a1, b1, a2}), 1)
+}
+
+// fakeS3 is an in-memory S3 server listing pageSize keys at a time.
+type fakeS3 struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+	pageSize int
+	pages    int
+	// delays holds requests of an object path for a time.
+	delays map[string]time.Duration
+	// denied refuses writes to an object path.
+	denied map[string]bool
+}
+
+type fakeObject struct {
+	data     []byte
+	metadata map[string]string
+	tags     map[string]string
+	modified time.Time
+}
+
+type fakeTagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []struct {
+		Key   string
+		Value string
+	} `xml:"TagSet>Tag"`
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	// the session looks the credentials up in the environment
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	s := &fakeS3{objects: map[string]*fakeObject{}, pageSize: 2}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+func (s *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	delay := s.delays[strings.TrimPrefix(r.URL.Path, "/")]
+	s.mu.Unlock()
+	time.Sleep(delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) == 1 {
+		s.list(w, r, parts[0])
+		return
+	}
+	name := parts[0] + "/" + parts[1]
+	_, tagging := r.URL.Query()["tagging"]
+
+	switch {
+	case r.Method == http.MethodGet && tagging:
+		obj, ok := s.objects[name]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		out := fakeTagging{}
+		for k, v := range obj.tags {
+			out.Tags = append(out.Tags, struct {
+				Key   string
+				Value string
+			}{k, v})
+		}
+		_ = xml.NewEncoder(w).Encode(out)
+
+	case r.Method == http.MethodHead:
+		obj, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for k, v := range obj.metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+
+	case r.Method == http.MethodGet:
+		obj, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		for k, v := range obj.metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		_, _ = w.Write(obj.data)
+
+	case r.Method == http.MethodPut && tagging:
+		in := fakeTagging{}
+		_ = xml.NewDecoder(r.Body).Decode(&in)
+		obj, ok := s.objects[name]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		obj.tags = map[string]string{}
+		for _, tag := range in.Tags {
+			obj.tags[tag.Key] = tag.Value
+		}
+
+	case r.Method == http.MethodPut && s.denied[name]:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>AccessDenied</Code></Error>")
+
+	case r.Method == http.MethodPut:
+		obj := &fakeObject{metadata: map[string]string{}, modified: time.Now()}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") {
+				obj.metadata[strings.TrimPrefix(k, "X-Amz-Meta-")] = v[0]
+			}
+		}
+
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(src)
+			orig, ok := s.objects[strings.TrimPrefix(src, "/")]
+			if !ok {
+				http.Error(w, "", http.StatusNotFound)
+				return
+			}
+			obj.data = orig.data
+			if tagging := r.Header.Get("X-Amz-Tagging"); tagging != "" {
+				tags, _ := url.ParseQuery(tagging)
+				obj.tags = map[string]string{}
+				for k := range tags {
+					obj.tags[k] = tags.Get(k)
+				}
+			}
+			fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+		} else {
+			obj.data, _ = ioutil.ReadAll(r.Body)
+		}
+		s.objects[name] = obj
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	s.pages++
+
+	q := r.URL.Query()
+	after := q.Get("start-after")
+	if token := q.Get("continuation-token"); token > after {
+		after = token
+	}
+
+	var keys []string
+	for name := range s.objects {
+		key := strings.TrimPrefix(name, bucket+"/")
+		if key == name || !strings.HasPrefix(key, q.Get("prefix")) || key <= after {
+			continue
+		}
+		if d := q.Get("delimiter"); d != "" && strings.Contains(strings.TrimPrefix(key, q.Get("prefix")), d) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	truncated := len(keys) > s.pageSize
+	if truncated {
+		keys = keys[:s.pageSize]
+	}
+
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, key := range keys {
+		obj := s.objects[bucket+"/"+key]
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>",
+			html.EscapeString(key), obj.modified.UTC().Format(time.RFC3339), len(obj.data))
+	}
+	fmt.Fprintf(w, "<IsTruncated>%t</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", html.EscapeString(keys[len(keys)-1]))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// put stores an archive object of the messages.
+func (s *fakeS3) put(t *testing.T, bucket, key string, msgs Messages) {
+	b, err := encodeObject(msgs, CompressionNone)
+	assert.NoError(t, err)
+
+	s.putRaw(bucket, key, b)
+}
+
+// putRaw stores an object as is.
+func (s *fakeS3) putRaw(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[bucket+"/"+key] = &fakeObject{data: data, metadata: map[string]string{}, modified: time.Now()}
+}
+
+// object returns a stored object.
+func (s *fakeS3) object(bucket, key string) (*fakeObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[bucket+"/"+key]
+	return obj, ok
+}
+
+// keys returns the keys of a bucket in order.
+func (s *fakeS3) keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for name := range s.objects {
+		if strings.HasPrefix(name, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(name, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// archiveKeys returns n default layout keys in time order.
+func archiveKeys(n int) []string {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var keys []string
+	for i := 0; i < n; i++ {
+		id, _ := ksuid.NewRandomWithTime(ts.Add(time.Duration(i) * time.Second))
+		keys = append(keys, id.String()+objectExt)
+	}
+
+	return keys
+}
+
+// drain reads the consumer output, acknowledging every message if ack is
+// true, and returns the messages and errors once the consumer is closed.
+func drain(t *testing.T, c Consumer, f Filter, ack bool) (Messages, []error) {
+	msgs, errs := c.Output(f)
+
+	var got Messages
+	for batch := range msgs {
+		for _, msg := range batch {
+			got = append(got, msg)
+			if ack {
+				msg.Acknowledge("kafka")
+			}
+		}
+	}
+	assert.NoError(t, c.Close())
+
+	var errors []error
+	for err := range errs {
+		errors = append(errors, err)
+	}
+
+	return got, errors
+}
+
+func TestS3Consumer_PaginatedListing(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(5)
+	for i, key := range keys {
+		s.put(t, "archive", key, Messages{{Topic: "test", Data: []byte{byte(i)}}})
+	}
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l)
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{}, true)
+
+	assert.Empty(t, errs)
+	if assert.Len(t, msgs, 5) {
+		for i, msg := range msgs {
+			assert.Equal(t, []byte{byte(i)}, msg.Data)
+		}
+	}
+	assert.Equal(t, 3, s.pages)
+	assert.Empty(t, s.keys("archive"))
+}
+
+func TestS3Consumer_ConcurrentDownloadsKeepListingOrder(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(6)
+	for i, key := range keys {
+		s.put(t, "archive", key, Messages{{Topic: "test", Data: []byte{byte(i)}}})
+	}
+	// the first objects finish downloading last
+	s.delays = map[string]time.Duration{
+		"archive/" + keys[0]: 100 * time.Millisecond,
+		"archive/" + keys[1]: 50 * time.Millisecond,
+	}
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Concurrency(4), WithS3ReadOnly())
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{}, false)
+
+	assert.Empty(t, errs)
+	if assert.Len(t, msgs, 6) {
+		for i, msg := range msgs {
+			assert.Equal(t, []byte{byte(i)}, msg.Data)
+		}
+	}
+}
+
+func TestS3Consumer_ReadOnly(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(2)
+	s.put(t, "archive", keys[0], Messages{{Topic: "test"}})
+	s.put(t, "archive", keys[1], Messages{})
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3ReadOnly())
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{}, true)
+
+	assert.Empty(t, errs)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, keys, s.keys("archive"))
+}
+
+func TestS3Consumer_ObjectsCountsObjectsNotChunks(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(2)
+	big := Messages{}
+	for i := 0; i < consumeChunk+1; i++ {
+		big = append(big, &Message{Topic: "test"})
+	}
+	s.put(t, "archive", keys[0], big)
+	s.put(t, "archive", keys[1], Messages{{Topic: "test"}})
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3ReadOnly())
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{}, false)
+
+	assert.Empty(t, errs)
+	assert.Len(t, msgs, consumeChunk+2)
+	assert.Equal(t, 2, c.Objects())
+}
+
+func TestS3Consumer_ListsLegacyObjects(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(2)
+	s.put(t, "archive", keys[0], Messages{{Topic: "orders", Data: []byte("legacy")}})
+	s.put(t, "archive", "orders/"+keys[1], Messages{{Topic: "orders", Data: []byte("layout")}})
+	s.put(t, "archive", "payments/"+keys[1], Messages{{Topic: "payments"}})
+
+	l, _ := NewKeyLayout("{topic}/{ksuid}")
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3ReadOnly())
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{Include: []string{"orders"}}, false)
+
+	assert.Empty(t, errs)
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, []byte("legacy"), msgs[0].Data)
+		assert.Equal(t, []byte("layout"), msgs[1].Data)
+	}
+}
+
+func TestS3Consumer_ResumeRetriesFailedObjects(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(3)
+	s.put(t, "archive", keys[0], Messages{{Topic: "test", Data: []byte{0}}})
+	s.putRaw("archive", keys[1], []byte("{not json\n"))
+	s.put(t, "archive", keys[2], Messages{{Topic: "test", Data: []byte{2}}})
+
+	store := &memoryCheckpointStore{}
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Checkpoint(store, false))
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{}, true)
+
+	assert.Len(t, errs, 1)
+	assert.Len(t, msgs, 2)
+	// the failed object does not hold back the checkpoint
+	assert.Equal(t, keys[2], store.cp.Key)
+	assert.Empty(t, store.cp.Done)
+	assert.Equal(t, []string{keys[1]}, store.cp.Failed)
+
+	s.put(t, "archive", keys[1], Messages{{Topic: "test", Data: []byte{1}}})
+	c, err = NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Checkpoint(store, true))
+	assert.NoError(t, err)
+
+	msgs, errs = drain(t, c, Filter{}, true)
+
+	assert.Empty(t, errs)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, []byte{1}, msgs[0].Data)
+	}
+	assert.Equal(t, keys[2], store.cp.Key)
+	assert.Empty(t, store.cp.Failed)
+	assert.Empty(t, s.keys("archive"))
+}
+
+func TestS3Consumer_MoveKeepsACopyPerRun(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	key := archiveKeys(1)[0]
+	s.put(t, "archive", key, Messages{{Topic: "orders"}, {Topic: "payments"}})
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	for _, run := range []struct {
+		id    string
+		topic string
+	}{{"first", "orders"}, {"second", "payments"}} {
+		r := Restored{Mode: RestoredMove, Prefix: "restored/", RunID: run.id}
+		c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Restored(r))
+		assert.NoError(t, err)
+
+		msgs, errs := drain(t, c, Filter{Include: []string{run.topic}}, true)
+		assert.Empty(t, errs)
+		assert.Len(t, msgs, 1)
+	}
+
+	assert.Equal(t, []string{"restored/first/" + key, "restored/second/" + key}, s.keys("archive"))
+	first, _ := s.object("archive", "restored/first/"+key)
+	second, _ := s.object("archive", "restored/second/"+key)
+	assert.Equal(t, "first", first.metadata["Restore-Run"])
+	assert.Equal(t, "second", second.metadata["Restore-Run"])
+	assert.NotEqual(t, first.data, second.data)
+}
+
+func TestS3Consumer_TagKeepsATaggedCopyOfAPartlyRestoredObject(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	key := archiveKeys(1)[0]
+	s.put(t, "archive", key, Messages{{Topic: "orders"}, {Topic: "payments"}})
+	orig, _ := s.object("archive", key)
+	data := orig.data
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	r := Restored{Mode: RestoredTag, RunID: "run"}
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Restored(r))
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{Include: []string{"orders"}}, true)
+	assert.Empty(t, errs)
+	assert.Len(t, msgs, 1)
+
+	assert.Equal(t, []string{key, "restored/run/" + key}, s.keys("archive"))
+	rest, _ := s.object("archive", key)
+	assert.Empty(t, rest.tags)
+	assert.NotEqual(t, data, rest.data)
+
+	copied, _ := s.object("archive", "restored/run/"+key)
+	assert.Equal(t, data, copied.data)
+	assert.Equal(t, "run", copied.tags["restore-run"])
+	assert.Equal(t, "1", copied.tags["restored-messages"])
+	assert.NotEmpty(t, copied.tags["restored-at"])
+
+	// the rest is restored and tagged by the next run, the copy is skipped
+	r.RunID = "next"
+	c, err = NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Restored(r))
+	assert.NoError(t, err)
+
+	msgs, errs = drain(t, c, Filter{}, true)
+	assert.Empty(t, errs)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "payments", msgs[0].Topic)
+	}
+	rest, _ = s.object("archive", key)
+	assert.Equal(t, "next", rest.tags["restore-run"])
+}
+
+func TestS3Consumer_SkipsObjectsRestoredInAnotherMode(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(3)
+	s.put(t, "archive", keys[0], Messages{{Topic: "orders", Data: []byte{0}}})
+	s.put(t, "archive", keys[1], Messages{{Topic: "orders", Data: []byte{1}}})
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	r := Restored{Mode: RestoredMove, Prefix: DefaultRestoredPrefix, RunID: "move"}
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Restored(r))
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{}, true)
+	assert.Empty(t, errs)
+	assert.Len(t, msgs, 2)
+
+	// an object tagged by an earlier run and a new object
+	s.put(t, "archive", keys[0], Messages{{Topic: "orders", Data: []byte{0}}})
+	tagged, _ := s.object("archive", keys[0])
+	tagged.tags = map[string]string{"restored-at": time.Now().UTC().Format(time.RFC3339)}
+	s.put(t, "archive", keys[2], Messages{{Topic: "orders", Data: []byte{2}}})
+
+	// the default delete mode skips the moved and the tagged objects
+	c, err = NewS3Consumer(s.URL, "eu-west-1", "archive", l)
+	assert.NoError(t, err)
+
+	msgs, errs = drain(t, c, Filter{}, true)
+	assert.Empty(t, errs)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, []byte{2}, msgs[0].Data)
+	}
+	assert.Equal(t, []string{keys[0], "restored/move/" + keys[0], "restored/move/" + keys[1]}, s.keys("archive"))
+}
+
+func TestS3Cleaner_CleanOnlyRemovesRestoredObjects(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	keys := archiveKeys(2)
+	s.put(t, "archive", keys[0], Messages{{Topic: "test"}})
+	s.put(t, "archive", keys[1], Messages{{Topic: "test"}})
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	r := Restored{Mode: RestoredMove, Bucket: "audit", RunID: "run"}
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l, WithS3Restored(r))
+	assert.NoError(t, err)
+	_, errs := drain(t, c, Filter{}, true)
+	assert.Empty(t, errs)
+
+	// an object of the restored bucket that was not moved there by a restore
+	s.put(t, "audit", "reports/2020.csv", Messages{})
+	moved := []string{"run/" + keys[0], "run/" + keys[1]}
+	assert.Equal(t, append([]string{"reports/2020.csv"}, moved...), s.keys("audit"))
+
+	cleaner, err := NewS3Cleaner(s.URL, "eu-west-1", "archive", r)
+	assert.NoError(t, err)
+
+	var removed []string
+	err = cleaner.Clean(time.Now().Add(time.Hour), false, func(key string) {
+		removed = append(removed, key)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, moved, removed)
+	assert.Equal(t, []string{"reports/2020.csv"}, s.keys("audit"))
+}
+
+func TestS3Consumer_FailedRewriteKeepsTheObject(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	key := archiveKeys(1)[0]
+	s.put(t, "archive", key, Messages{{Topic: "orders"}, {Topic: "payments"}})
+	original, _ := s.object("archive", key)
+	s.denied = map[string]bool{"archive/" + key: true}
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l)
+	assert.NoError(t, err)
+
+	msgs, errs := drain(t, c, Filter{Include: []string{"orders"}}, true)
+
+	assert.Len(t, msgs, 1)
+	if assert.Len(t, errs, 1) {
+		assert.Contains(t, errs[0].Error(), "will be restored again")
+	}
+	obj, ok := s.object("archive", key)
+	if assert.True(t, ok) {
+		assert.Equal(t, original.data, obj.data)
+	}
+
+	// the next restore replays the matched messages again
+	s.denied = nil
+	c, err = NewS3Consumer(s.URL, "eu-west-1", "archive", l)
+	assert.NoError(t, err)
+
+	msgs, errs = drain(t, c, Filter{Include: []string{"orders"}}, true)
+
+	assert.Empty(t, errs)
+	assert.Len(t, msgs, 1)
+	rest, _ := s.object("archive", key)
+	assert.NotEqual(t, original.data, rest.data)
+}
+
+func TestS3Consumer_RewriteKeepsUnmatchedMessagesInOrder(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.Close()
+
+	key := archiveKeys(1)[0]
+	var msgs Messages
+	for i := 0; i < consumeChunk*2+10; i++ {
+		topic := "orders"
+		if i%3 == 0 {
+			topic = "payments"
+		}
+		msgs = append(msgs, &Message{Topic: topic, Key: []byte(strconv.Itoa(i))})
+	}
+	s.put(t, "archive", key, msgs)
+
+	l, _ := NewKeyLayout(DefaultKeyLayout)
+	c, err := NewS3Consumer(s.URL, "eu-west-1", "archive", l)
+	assert.NoError(t, err)
+
+	restored, errs := drain(t, c, Filter{Include: []string{"orders"}}, true)
+	assert.Empty(t, errs)
+
+	obj, ok := s.object("archive", key)
+	if !assert.True(t, ok) {
+		return
+	}
+	r, err := newObjectReader(bytes.NewReader(obj.data), CompressionNone)
+	assert.NoError(t, err)
+	rest, err := r.Next(len(msgs))
+	assert.NoError(t, err)
+
+	var want Messages
+	for _, msg := range msgs {
+		if msg.Topic == "payments" {
+			want = append(want, msg)
+		}
+	}
+	assert.Equal(t, want, rest)
+	assert.Len(t, restored, len(msgs)-len(want))
+}
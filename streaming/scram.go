@@ -0,0 +1,48 @@
+package streaming
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+var (
+	scramSHA256 scram.HashGeneratorFcn = func() hash.Hash { return sha256.New() }
+	scramSHA512 scram.HashGeneratorFcn = func() hash.Hash { return sha512.New() }
+)
+
+// scramClient implements the sarama SCRAM client.
+type scramClient struct {
+	hashFn scram.HashGeneratorFcn
+	conv   *scram.ClientConversation
+}
+
+func newSCRAMClient(hashFn scram.HashGeneratorFcn) func() sarama.SCRAMClient {
+	return func() sarama.SCRAMClient {
+		return &scramClient{hashFn: hashFn}
+	}
+}
+
+// Begin prepares the client for the SCRAM exchange.
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hashFn.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+
+	c.conv = client.NewConversation()
+	return nil
+}
+
+// Step steps the client through the SCRAM exchange.
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+// Done reports whether the SCRAM exchange is done.
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
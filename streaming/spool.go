@@ -0,0 +1,692 @@
+package streaming
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SyncPolicy determines when the spool flushes segments to disk.
+type SyncPolicy string
+
+// Spool sync policies.
+const (
+	// SyncAlways syncs the segment after every message.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs the segment periodically.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves syncing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+// Spool producer defaults.
+const (
+	DefaultSpoolSegmentSize  = 64 << 20
+	DefaultSpoolSyncInterval = time.Second
+	DefaultSpoolSealInterval = time.Minute
+)
+
+// Spool segment file extensions. Only sealed segments are read by the
+// consumer, which keeps a copy of segments with undecodable records.
+const (
+	spoolActiveExt  = ".active"
+	spoolSealedExt  = ".seg"
+	spoolCorruptExt = ".corrupt"
+)
+
+// ErrSpoolFull is the error returned when the spool has reached its size cap.
+var ErrSpoolFull = errors.New("spool: size cap reached")
+
+// SpoolOptFunc represents a configuration function for the spool producer.
+type SpoolOptFunc func(p *spoolProducer)
+
+// WithSpoolName sets the name of the producer.
+func WithSpoolName(name string) SpoolOptFunc {
+	return SpoolOptFunc(func(p *spoolProducer) {
+		p.name = name
+	})
+}
+
+// WithSpoolSealInterval sets the age at which the active segment is sealed
+// even if it has not reached the segment size, so that its messages can be
+// restored while the producer runs. Disabled if zero.
+func WithSpoolSealInterval(d time.Duration) SpoolOptFunc {
+	return SpoolOptFunc(func(p *spoolProducer) {
+		p.sealInterval = d
+	})
+}
+
+type spoolProducer struct {
+	name         string
+	dir          string
+	segmentSize  int64
+	maxSize      int64
+	sync         SyncPolicy
+	syncInterval time.Duration
+	sealInterval time.Duration
+
+	seq     uint64
+	file    *os.File
+	opened  time.Time
+	written int64
+	size    int64
+	healthy int32
+
+	input  chan *Message
+	errors chan *Error
+	wg     sync.WaitGroup
+}
+
+// NewSpoolProducer creates a producer that appends messages to segment files on local disk.
+//
+// A segment is rotated once it reaches segmentSize bytes. A maxSize of zero
+// disables the size cap of the spool directory.
+func NewSpoolProducer(dir string, segmentSize, maxSize int64, policy SyncPolicy, syncInterval time.Duration, opts ...SpoolOptFunc) (Producer, error) {
+	switch policy {
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if syncInterval <= 0 {
+			return nil, errors.New("spool: sync interval must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("spool: unknown sync policy %q", policy)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	p := &spoolProducer{
+		name:         "spool",
+		dir:          dir,
+		segmentSize:  segmentSize,
+		maxSize:      maxSize,
+		sync:         policy,
+		syncInterval: syncInterval,
+		healthy:      1,
+		input:        make(chan *Message),
+		errors:       make(chan *Error),
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if err := p.recover(); err != nil {
+		return nil, err
+	}
+
+	if err := p.openSegment(); err != nil {
+		return nil, err
+	}
+
+	p.wg.Add(1)
+	go p.dispatchMessages()
+
+	return p, nil
+}
+
+// Name is the name of the producer.
+func (p *spoolProducer) Name() string {
+	return p.name
+}
+
+// Input is the message input channel.
+func (p *spoolProducer) Input() chan<- *Message {
+	return p.input
+}
+
+// Errors is the error output channel.
+func (p *spoolProducer) Errors() <-chan *Error {
+	return p.errors
+}
+
+// Close closes the producer.
+func (p *spoolProducer) Close() error {
+	close(p.input)
+	p.wg.Wait()
+
+	err := p.sealSegment()
+
+	close(p.errors)
+
+	return err
+}
+
+// IsHealthy checks the health of the producer.
+func (p *spoolProducer) IsHealthy() bool {
+	return atomic.LoadInt32(&p.healthy) == 1
+}
+
+// recover seals segments left active by a previous run and sizes the spool.
+func (p *spoolProducer) recover() error {
+	segments, err := listSegments(p.dir, "")
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segments {
+		if seq := segmentSeq(seg.Name()); seq > p.seq {
+			p.seq = seq
+		}
+		p.size += seg.Size()
+
+		if strings.HasSuffix(seg.Name(), spoolActiveExt) {
+			path := filepath.Join(p.dir, seg.Name())
+			if err := os.Rename(path, strings.TrimSuffix(path, spoolActiveExt)+spoolSealedExt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *spoolProducer) dispatchMessages() {
+	defer p.wg.Done()
+
+	var tick <-chan time.Time
+	if p.sync == SyncInterval {
+		ticker := time.NewTicker(p.syncInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var sealTick <-chan time.Time
+	if p.sealInterval > 0 {
+		ticker := time.NewTicker(p.sealInterval / 2)
+		defer ticker.Stop()
+		sealTick = ticker.C
+	}
+
+	for {
+		select {
+		case msg, ok := <-p.input:
+			if !ok {
+				return
+			}
+
+			if err := p.write(msg); err != nil {
+				atomic.StoreInt32(&p.healthy, 0)
+				p.errors <- &Error{
+					Msgs: Messages{msg},
+					Err:  err,
+				}
+				continue
+			}
+
+			atomic.StoreInt32(&p.healthy, 1)
+			msg.Acknowledge(p.Name())
+
+		case <-tick:
+			if err := p.file.Sync(); err != nil {
+				atomic.StoreInt32(&p.healthy, 0)
+			}
+
+		case <-sealTick:
+			if p.written == 0 || time.Since(p.opened) < p.sealInterval {
+				continue
+			}
+			if err := p.rotateSegment(); err != nil {
+				atomic.StoreInt32(&p.healthy, 0)
+			}
+		}
+	}
+}
+
+// write appends a length prefixed record to the active segment.
+func (p *spoolProducer) write(msg *Message) error {
+	buf, err := encodeRecord(msg)
+	if err != nil {
+		return err
+	}
+
+	n := int64(len(buf))
+	if p.maxSize > 0 && p.size+n > p.maxSize {
+		// Segments may have been restored since the spool was sized
+		if err := p.resize(); err != nil {
+			return err
+		}
+		if p.size+n > p.maxSize {
+			return ErrSpoolFull
+		}
+	}
+
+	if p.written > 0 && p.written+n > p.segmentSize {
+		if err := p.rotateSegment(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.file.Write(buf); err != nil {
+		return err
+	}
+	p.written += n
+	p.size += n
+
+	if p.sync == SyncAlways {
+		return p.file.Sync()
+	}
+
+	return nil
+}
+
+func (p *spoolProducer) resize() error {
+	segments, err := listSegments(p.dir, "")
+	if err != nil {
+		return err
+	}
+
+	p.size = 0
+	for _, seg := range segments {
+		p.size += seg.Size()
+	}
+
+	return nil
+}
+
+func (p *spoolProducer) rotateSegment() error {
+	if err := p.sealSegment(); err != nil {
+		return err
+	}
+
+	return p.openSegment()
+}
+
+func (p *spoolProducer) openSegment() error {
+	p.seq++
+
+	f, err := os.OpenFile(p.segmentPath(p.seq, spoolActiveExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	p.file = f
+	p.opened = time.Now()
+	p.written = 0
+
+	return nil
+}
+
+// sealSegment syncs and closes the active segment, making it visible to consumers.
+func (p *spoolProducer) sealSegment() error {
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+
+	active := p.segmentPath(p.seq, spoolActiveExt)
+	if p.written == 0 {
+		return os.Remove(active)
+	}
+
+	return os.Rename(active, p.segmentPath(p.seq, spoolSealedExt))
+}
+
+func (p *spoolProducer) segmentPath(seq uint64, ext string) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%020d%s", seq, ext))
+}
+
+// SpoolConsumerOptFunc represents a configuration function for the spool consumer.
+type SpoolConsumerOptFunc func(c *spoolConsumer)
+
+// WithSpoolReadOnly makes the consumer leave the spool directory untouched:
+// no segment is removed or rewritten, even once its messages are
+// acknowledged.
+func WithSpoolReadOnly() SpoolConsumerOptFunc {
+	return SpoolConsumerOptFunc(func(c *spoolConsumer) {
+		c.readOnly = true
+	})
+}
+
+type spoolConsumer struct {
+	dir      string
+	readOnly bool
+
+	objects  int64
+	errors   chan error
+	errorsMu sync.RWMutex
+	closed   bool
+	done     chan struct{}
+	outputWg sync.WaitGroup
+}
+
+// NewSpoolConsumer creates a consumer that gets messages from a spool directory.
+//
+// Segments are only removed once every message they contain has been
+// acknowledged by a producer.
+func NewSpoolConsumer(dir string, opts ...SpoolConsumerOptFunc) (Consumer, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	c := &spoolConsumer{
+		dir:    dir,
+		errors: make(chan error, 10),
+		done:   make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// Output gets the messages passing the filter.
+func (c *spoolConsumer) Output(f Filter) (<-chan Messages, <-chan error) {
+	ch := make(chan Messages, 10)
+
+	c.outputWg.Add(1)
+	go func() {
+		defer c.outputWg.Done()
+		defer close(ch)
+
+		segments, err := listSegments(c.dir, spoolSealedExt)
+		if err != nil {
+			c.error(err)
+			return
+		}
+
+		for _, seg := range segments {
+			if f.Before(seg.ModTime()) {
+				continue
+			}
+			if f.After(seg.ModTime()) {
+				// segments are sealed in order, we can stop here
+				return
+			}
+
+			path := filepath.Join(c.dir, seg.Name())
+			msgs, corrupt, err := readSegment(path)
+			switch {
+			case err == io.ErrUnexpectedEOF:
+				// the tail was never acknowledged to the producer
+				c.error(errors.Wrap(err, path+": truncated record"))
+			case err != nil:
+				// keep the segment, it cannot be rewritten without its records
+				c.error(errors.Wrap(err, path))
+				continue
+			}
+
+			if corrupt > 0 {
+				c.error(fmt.Errorf("%s: %d undecodable records", path, corrupt))
+				if !c.readOnly {
+					// keep the undecodable records for inspection
+					if err := copyFile(path, path+spoolCorruptExt, seg.ModTime()); err != nil {
+						c.error(err)
+						continue
+					}
+				}
+			}
+
+			if len(msgs) == 0 {
+				if !c.readOnly {
+					c.remove(path)
+				}
+				continue
+			}
+
+			matched, rest := f.Split(msgs)
+			if len(matched) == 0 {
+				continue
+			}
+			modTime := seg.ModTime()
+			trackAcks(matched, func() {
+				if c.readOnly {
+					return
+				}
+				if len(rest) > 0 {
+					c.rewrite(path, rest, modTime)
+					return
+				}
+				c.remove(path)
+			})
+
+			select {
+			case ch <- matched:
+				atomic.AddInt64(&c.objects, 1)
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	return ch, c.errors
+}
+
+// remove deletes a fully acknowledged segment.
+func (c *spoolConsumer) remove(path string) {
+	if c.isClosed() {
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		c.error(err)
+	}
+}
+
+// rewrite replaces a segment with the messages that were filtered out of it,
+// keeping its modification time.
+func (c *spoolConsumer) rewrite(path string, msgs Messages, modTime time.Time) {
+	if c.isClosed() {
+		return
+	}
+
+	if err := writeSegment(path, msgs, modTime); err != nil {
+		c.error(err)
+	}
+}
+
+// error reports an error unless the consumer has been closed.
+func (c *spoolConsumer) error(err error) {
+	c.errorsMu.RLock()
+	defer c.errorsMu.RUnlock()
+
+	if c.closed {
+		return
+	}
+	c.errors <- err
+}
+
+func (c *spoolConsumer) isClosed() bool {
+	c.errorsMu.RLock()
+	defer c.errorsMu.RUnlock()
+
+	return c.closed
+}
+
+// Close closes the consumer.
+//
+// Messages acknowledged after Close will not remove their segment.
+func (c *spoolConsumer) Close() error {
+	close(c.done)
+	c.outputWg.Wait()
+
+	c.errorsMu.Lock()
+	c.closed = true
+	close(c.errors)
+	c.errorsMu.Unlock()
+
+	return nil
+}
+
+// Objects returns the number of segments messages have been output from.
+func (c *spoolConsumer) Objects() int {
+	return int(atomic.LoadInt64(&c.objects))
+}
+
+// IsHealthy checks the health of the Consumer.
+func (c *spoolConsumer) IsHealthy() bool {
+	return true
+}
+
+// listSegments returns the segment files in the directory in write order.
+// An empty ext matches both active and sealed segments.
+func listSegments(dir, ext string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []os.FileInfo
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		name := f.Name()
+		if ext == "" && (strings.HasSuffix(name, spoolActiveExt) || strings.HasSuffix(name, spoolSealedExt)) ||
+			ext != "" && strings.HasSuffix(name, ext) {
+			segments = append(segments, f)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segmentSeq(segments[i].Name()) < segmentSeq(segments[j].Name())
+	})
+
+	return segments, nil
+}
+
+func segmentSeq(name string) uint64 {
+	var seq uint64
+	_, _ = fmt.Sscanf(name, "%d", &seq)
+	return seq
+}
+
+// encodeRecord encodes a message as a length prefixed record.
+func encodeRecord(msg *Message) ([]byte, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, len(b)+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+
+	return buf, nil
+}
+
+// writeSegment atomically replaces a segment with the given messages.
+func writeSegment(path string, msgs Messages, modTime time.Time) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, msg := range msgs {
+		buf, err := encodeRecord(msg)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp, modTime, modTime); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// readSegment reads all records of a segment and returns the number of
+// records that could not be decoded, which are skipped. A truncated trailing
+// record, as left by a crash, is reported as io.ErrUnexpectedEOF alongside
+// the complete records.
+func readSegment(path string) (Messages, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	remaining := info.Size()
+
+	r := bufio.NewReader(f)
+	msgs := Messages{}
+	corrupt := 0
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			if err == io.EOF {
+				return msgs, corrupt, nil
+			}
+			return msgs, corrupt, err
+		}
+		remaining -= int64(len(head))
+
+		n := int64(binary.BigEndian.Uint32(head))
+		if n > remaining {
+			return msgs, corrupt, io.ErrUnexpectedEOF
+		}
+
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return msgs, corrupt, err
+		}
+		remaining -= n
+
+		msg := &Message{}
+		if err := json.Unmarshal(b, msg); err != nil {
+			// the length prefix is intact, so the next record can still be read
+			corrupt++
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// copyFile copies a file, keeping its modification time.
+func copyFile(src, dst string, modTime time.Time) error {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(dst, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, modTime, modTime)
+}
@@ -0,0 +1,268 @@
+package streaming
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool_RoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(dir, 100, 0, SyncAlways, 0)
+	assert.NoError(t, err)
+
+	acks := 0
+	for i := 0; i < 5; i++ {
+		p.Input() <- &Message{
+			Topic: "test",
+			Key:   []byte("key"),
+			Data:  []byte("data"),
+			Ack: func(producer string) {
+				assert.Equal(t, "spool", producer)
+				acks++
+			},
+		}
+	}
+	assert.NoError(t, p.Close())
+	assert.Equal(t, 5, acks)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSealedExt))
+	assert.True(t, len(segments) > 1, "expected segments to be rotated")
+
+	c, err := NewSpoolConsumer(dir)
+	assert.NoError(t, err)
+
+	msgs, errs := c.Output(Filter{To: time.Now()})
+	count := 0
+	for batch := range msgs {
+		for _, msg := range batch {
+			count++
+			assert.Equal(t, "test", msg.Topic)
+			assert.Equal(t, []byte("key"), msg.Key)
+			assert.Equal(t, []byte("data"), msg.Data)
+			msg.Acknowledge("kafka")
+		}
+	}
+	assert.NoError(t, c.Close())
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, 5, count)
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"))
+	assert.Len(t, segments, 0)
+}
+
+func TestSpool_KeepsUnacknowledgedSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(dir, 1024, 0, SyncNever, 0)
+	assert.NoError(t, err)
+	p.Input() <- &Message{Topic: "test"}
+	p.Input() <- &Message{Topic: "test"}
+	assert.NoError(t, p.Close())
+
+	c, err := NewSpoolConsumer(dir)
+	assert.NoError(t, err)
+
+	msgs, _ := c.Output(Filter{To: time.Now()})
+	for batch := range msgs {
+		batch[0].Acknowledge("kafka")
+	}
+	assert.NoError(t, c.Close())
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSealedExt))
+	assert.Len(t, segments, 1)
+}
+
+func TestSpool_SizeCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(dir, 1024, 10, SyncNever, 0)
+	assert.NoError(t, err)
+
+	go func() {
+		p.Input() <- &Message{Topic: "test"}
+	}()
+
+	err = (<-p.Errors()).Err
+	assert.Equal(t, ErrSpoolFull, err)
+	assert.False(t, p.IsHealthy())
+	assert.NoError(t, p.Close())
+}
+
+func TestSpool_RecoversActiveSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(dir, 1024, 0, SyncAlways, 0)
+	assert.NoError(t, err)
+	p.Input() <- &Message{Topic: "test"}
+
+	// Simulate a crash by opening a new producer without closing the first
+	_, err = NewSpoolProducer(dir, 1024, 0, SyncAlways, 0)
+	assert.NoError(t, err)
+
+	msgs, corrupt, err := readSegment(filepath.Join(dir, "00000000000000000001"+spoolSealedExt))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, corrupt)
+	assert.Len(t, msgs, 1)
+}
+
+func TestNewSpoolProducer_InvalidSyncPolicy(t *testing.T) {
+	_, err := NewSpoolProducer(os.TempDir(), 1024, 0, SyncPolicy("sometimes"), 0)
+	assert.Error(t, err)
+
+	_, err = NewSpoolProducer(os.TempDir(), 1024, 0, SyncInterval, 0)
+	assert.Error(t, err)
+}
+
+func TestSpool_FilterKeepsUnmatchedMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(dir, 1024, 0, SyncNever, 0)
+	assert.NoError(t, err)
+	p.Input() <- &Message{Topic: "orders"}
+	p.Input() <- &Message{Topic: "payments"}
+	p.Input() <- &Message{Topic: "orders"}
+	assert.NoError(t, p.Close())
+
+	c, err := NewSpoolConsumer(dir)
+	assert.NoError(t, err)
+
+	msgs, _ := c.Output(Filter{Include: []string{"orders"}})
+	count := 0
+	for batch := range msgs {
+		for _, msg := range batch {
+			count++
+			assert.Equal(t, "orders", msg.Topic)
+			msg.Acknowledge("kafka")
+		}
+	}
+	assert.NoError(t, c.Close())
+	assert.Equal(t, 2, count)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSealedExt))
+	if assert.Len(t, segments, 1) {
+		rest, _, err := readSegment(segments[0])
+		assert.NoError(t, err)
+		assert.Equal(t, Messages{{Topic: "payments"}}, rest)
+	}
+
+	c, err = NewSpoolConsumer(dir)
+	assert.NoError(t, err)
+	msgs, _ = c.Output(Filter{To: time.Now().Add(-time.Hour)})
+	for range msgs {
+		assert.Fail(t, "expected segment to be outside the time range")
+	}
+	assert.NoError(t, c.Close())
+}
+
+func TestSpool_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(dir, 1024, 0, SyncNever, 0)
+	assert.NoError(t, err)
+	p.Input() <- &Message{Topic: "test"}
+	assert.NoError(t, p.Close())
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "00000000000000000009"+spoolSealedExt), nil, 0644))
+
+	c, err := NewSpoolConsumer(dir, WithSpoolReadOnly())
+	assert.NoError(t, err)
+
+	msgs, _ := c.Output(Filter{To: time.Now()})
+	for batch := range msgs {
+		for _, msg := range batch {
+			msg.Acknowledge("kafka")
+		}
+	}
+	assert.NoError(t, c.Close())
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSealedExt))
+	assert.Len(t, segments, 2)
+}
+
+func TestSpool_SkipsUndecodableRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bad := []byte("{not json")
+	corruptRec := make([]byte, 4+len(bad))
+	binary.BigEndian.PutUint32(corruptRec, uint32(len(bad)))
+	copy(corruptRec[4:], bad)
+
+	a, _ := encodeRecord(&Message{Topic: "a"})
+	b, _ := encodeRecord(&Message{Topic: "b"})
+	b = append(append(a, corruptRec...), b...)
+	// a truncated tail, as left by a crash
+	b = append(b, 0, 0, 1)
+
+	path := filepath.Join(dir, "00000000000000000001"+spoolSealedExt)
+	assert.NoError(t, ioutil.WriteFile(path, b, 0644))
+
+	msgs, corrupt, err := readSegment(path)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 1, corrupt)
+	assert.Equal(t, Messages{{Topic: "a"}, {Topic: "b"}}, msgs)
+
+	c, err := NewSpoolConsumer(dir)
+	assert.NoError(t, err)
+
+	out, errs := c.Output(Filter{To: time.Now().Add(time.Hour)})
+	count := 0
+	for batch := range out {
+		for _, msg := range batch {
+			count++
+			msg.Acknowledge("kafka")
+		}
+	}
+	assert.NoError(t, c.Close())
+	n := 0
+	for range errs {
+		n++
+	}
+
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 2, n)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path + spoolCorruptExt)
+	assert.NoError(t, err)
+}
+
+func TestSpool_SealInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p, err := NewSpoolProducer(dir, 1024, 0, SyncNever, 0, WithSpoolSealInterval(20*time.Millisecond))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	p.Input() <- &Message{Topic: "test"}
+
+	// the seal is checked every half interval
+	time.Sleep(100 * time.Millisecond)
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSealedExt))
+	assert.Len(t, segments, 1)
+}
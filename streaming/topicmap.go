@@ -0,0 +1,66 @@
+package streaming
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TopicMap rewrites the topics of restored messages.
+//
+// Explicit rules take precedence over the prefix and suffix, which are
+// applied to all other topics. A rule without a target drops the topic: its
+// messages are not restored.
+type TopicMap struct {
+	rules  map[string]string
+	prefix string
+	suffix string
+}
+
+// NewTopicMap creates a TopicMap from "from=to" rules and a prefix and suffix.
+func NewTopicMap(rules []string, prefix, suffix string) (*TopicMap, error) {
+	m := &TopicMap{
+		rules:  make(map[string]string, len(rules)),
+		prefix: prefix,
+		suffix: suffix,
+	}
+
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("topicmap: invalid rule %q, expected 'from=to'", rule)
+		}
+
+		m.rules[parts[0]] = parts[1]
+	}
+
+	return m, nil
+}
+
+// Map returns the topic to send messages of the given topic to, and false
+// if the messages should be dropped.
+func (m *TopicMap) Map(topic string) (string, bool) {
+	if to, ok := m.rules[topic]; ok {
+		return to, to != ""
+	}
+
+	return m.prefix + topic + m.suffix, true
+}
+
+// Exclude returns the filter with the topics the map drops excluded, so that
+// their messages are kept in the source like any other unmatched message.
+func (m *TopicMap) Exclude(f Filter) Filter {
+	var dropped []string
+	for from, to := range m.rules {
+		if to == "" {
+			dropped = append(dropped, patternEscaper.Replace(from))
+		}
+	}
+	sort.Strings(dropped)
+
+	f.Exclude = append(append([]string{}, f.Exclude...), dropped...)
+	return f
+}
+
+// patternEscaper escapes the path.Match meta characters of a topic.
+var patternEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`)
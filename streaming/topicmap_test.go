@@ -0,0 +1,52 @@
+package streaming
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicMap_Map(t *testing.T) {
+	m, err := NewTopicMap([]string{"orders=orders.replay", "debug="}, "", ".staging")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		topic string
+		want  string
+		keep  bool
+	}{
+		{"orders", "orders.replay", true},
+		{"debug", "", false},
+		{"payments", "payments.staging", true},
+	}
+
+	for _, tt := range tests {
+		got, keep := m.Map(tt.topic)
+
+		assert.Equal(t, tt.want, got)
+		assert.Equal(t, tt.keep, keep)
+	}
+}
+
+func TestNewTopicMap_InvalidRule(t *testing.T) {
+	_, err := NewTopicMap([]string{"orders"}, "", "")
+	assert.Error(t, err)
+
+	_, err = NewTopicMap([]string{"=orders"}, "", "")
+	assert.Error(t, err)
+}
+
+func TestTopicMap_Exclude(t *testing.T) {
+	m, err := NewTopicMap([]string{"orders=orders.replay", "debug=", "tmp*="}, "", "")
+	assert.NoError(t, err)
+
+	f := Filter{Exclude: []string{"audit"}}
+	got := m.Exclude(f)
+
+	assert.Equal(t, []string{"audit", "debug", `tmp\*`}, got.Exclude)
+	assert.Equal(t, []string{"audit"}, f.Exclude)
+	assert.False(t, got.MatchTopic("debug"))
+	assert.False(t, got.MatchTopic("tmp*"))
+	assert.True(t, got.MatchTopic("tmp1"))
+	assert.True(t, got.MatchTopic("orders"))
+}
@@ -1,15 +1,99 @@
 package streaming
 
-import "time"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Messages is an array of messages.
 type Messages []*Message
 
+// Header is a key/value pair attached to a message.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
 // Message is the information to be sent through a Producer.
 type Message struct {
 	Topic string
 	Key   []byte
 	Data  []byte
+
+	// Headers are sent as Kafka record headers.
+	Headers []Header `json:",omitempty"`
+	// Partition is the explicit partition to produce to, if any.
+	Partition *int32 `json:",omitempty"`
+	// Timestamp is the explicit message timestamp, if not zero.
+	Timestamp time.Time
+
+	// Ack is called with the producer name once the message has been stored.
+	Ack func(producer string) `json:"-"`
+	// Nack is called when the message could not be stored by any producer.
+	Nack func(err error) `json:"-"`
+}
+
+// Acknowledge notifies the message owner that the message has been
+// stored by the given producer.
+func (m *Message) Acknowledge(producer string) {
+	if m.Ack != nil {
+		m.Ack(producer)
+	}
+}
+
+// Reject notifies the message owner that the message has been dropped.
+func (m *Message) Reject(err error) {
+	if m.Nack != nil {
+		m.Nack(err)
+	}
+}
+
+// trackAcks sets the acknowledgement of each message so that fn is called
+// once every message has been acknowledged. Repeated acknowledgements of
+// the same message are ignored.
+func trackAcks(msgs Messages, fn func()) {
+	t := newAckTracker()
+	t.track(msgs)
+	t.seal(fn)
+}
+
+// ackTracker tracks the acknowledgement of messages that are added
+// incrementally, calling its function once every message has been
+// acknowledged and no more messages will be added.
+type ackTracker struct {
+	pending int64
+	fn      func()
+}
+
+func newAckTracker() *ackTracker {
+	// the extra pending count is released by seal
+	return &ackTracker{pending: 1}
+}
+
+// track sets the acknowledgement of each message.
+func (t *ackTracker) track(msgs Messages) {
+	atomic.AddInt64(&t.pending, int64(len(msgs)))
+
+	for _, msg := range msgs {
+		once := sync.Once{}
+		msg.Ack = func(string) {
+			once.Do(t.done)
+		}
+	}
+}
+
+// seal marks the end of the tracked messages. A nil fn discards the
+// acknowledgements.
+func (t *ackTracker) seal(fn func()) {
+	t.fn = fn
+	t.done()
+}
+
+func (t *ackTracker) done() {
+	if atomic.AddInt64(&t.pending, -1) == 0 && t.fn != nil {
+		t.fn()
+	}
 }
 
 // Error is the error type returned by a Producer when an error occurs while
@@ -35,8 +119,11 @@ type Producer interface {
 
 // Consumer represents a class that can consume messages.
 type Consumer interface {
-	// Output gets messages until the given date.
-	Output(endTime time.Time) (<-chan Messages, <-chan error)
+	// Output gets the messages passing the filter.
+	Output(f Filter) (<-chan Messages, <-chan error)
+	// Objects returns the number of source objects messages have been
+	// output from.
+	Objects() int
 	// Close closes the producer.
 	Close() error
 	// IsHealthy checks the health of the Consumer.
@@ -0,0 +1,94 @@
+package streaming
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_trackAcks(t *testing.T) {
+	msgs := Messages{
+		{Topic: "test"},
+		{Topic: "test"},
+	}
+
+	done := 0
+	trackAcks(msgs, func() {
+		done++
+	})
+
+	msgs[0].Acknowledge("kafka")
+	msgs[0].Acknowledge("kafka")
+	assert.Equal(t, 0, done)
+
+	msgs[1].Acknowledge("kafka")
+	assert.Equal(t, 1, done)
+}
+
+func TestMessage_AcknowledgeWithoutAck(t *testing.T) {
+	m := &Message{Topic: "test"}
+
+	assert.NotPanics(t, func() {
+		m.Acknowledge("kafka")
+	})
+}
+
+func TestMessage_JSONRoundTrip(t *testing.T) {
+	partition := int32(2)
+	msgs := Messages{
+		{
+			Topic:     "test",
+			Key:       []byte("key"),
+			Data:      []byte("data"),
+			Headers:   []Header{{Key: "route", Value: []byte("eu")}},
+			Partition: &partition,
+			Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		},
+		{Topic: "test", Data: []byte("data")},
+	}
+
+	b, err := json.Marshal(msgs)
+	assert.NoError(t, err)
+
+	got := Messages{}
+	assert.NoError(t, json.Unmarshal(b, &got))
+	assert.Equal(t, msgs, got)
+}
+
+func TestMessage_JSONDecodesLegacyArchive(t *testing.T) {
+	got := Messages{}
+	err := json.Unmarshal([]byte(`[{"Topic":"test","Key":"a2V5","Data":"ZGF0YQ=="}]`), &got)
+
+	assert.NoError(t, err)
+	assert.Equal(t, Messages{{Topic: "test", Key: []byte("key"), Data: []byte("data")}}, got)
+}
+
+func TestAckTracker(t *testing.T) {
+	done := false
+	tracker := newAckTracker()
+
+	first := Messages{{}, {}}
+	tracker.track(first)
+	first[0].Acknowledge("kafka")
+	first[1].Acknowledge("kafka")
+	assert.False(t, done, "expected tracker to wait for seal")
+
+	second := Messages{{}}
+	tracker.track(second)
+	tracker.seal(func() { done = true })
+	assert.False(t, done)
+
+	second[0].Acknowledge("kafka")
+	assert.True(t, done)
+}
+
+func TestAckTracker_SealNil(t *testing.T) {
+	tracker := newAckTracker()
+	msgs := Messages{{}}
+	tracker.track(msgs)
+	tracker.seal(nil)
+
+	msgs[0].Acknowledge("kafka")
+}